@@ -357,3 +357,122 @@ var PgTypeMap = map[PgType]string{
 	PgTypeArrRegrole:       "PgTypeArrRegrole",
 	PgTypePgSubscription:   "PgTypePgSubscription",
 }
+
+// pgTypeNames 标准类型的数据库类型名，与 pg_type.typname 的大写形式一致（数组以 _ 开头），
+// 带时区的时间类型使用 SQL 标准名称
+var pgTypeNames = map[PgType]string{
+	PgTypeBool:           "BOOL",
+	PgTypeBytea:          "BYTEA",
+	PgTypeChar:           "CHAR",
+	PgTypeName:           "NAME",
+	PgTypeInt8:           "INT8",
+	PgTypeInt2:           "INT2",
+	PgTypeInt2vector:     "INT2VECTOR",
+	PgTypeInt4:           "INT4",
+	PgTypeRegproc:        "REGPROC",
+	PgTypeText:           "TEXT",
+	PgTypeOid:            "OID",
+	PgTypeTid:            "TID",
+	PgTypeXid:            "XID",
+	PgTypeCid:            "CID",
+	PgTypeOidvector:      "OIDVECTOR",
+	PgTypeJson:           "JSON",
+	PgTypeXml:            "XML",
+	PgTypeArrXml:         "_XML",
+	PgTypeArrJson:        "_JSON",
+	PgTypePoint:          "POINT",
+	PgTypeLseg:           "LSEG",
+	PgTypePath:           "PATH",
+	PgTypeBox:            "BOX",
+	PgTypePolygon:        "POLYGON",
+	PgTypeLine:           "LINE",
+	PgTypeArrLine:        "_LINE",
+	PgTypeCidr:           "CIDR",
+	PgTypeArrCidr:        "_CIDR",
+	PgTypeFloat4:         "FLOAT4",
+	PgTypeFloat8:         "FLOAT8",
+	PgTypeUnknown:        "UNKNOWN",
+	PgTypeCircle:         "CIRCLE",
+	PgTypeArrCircle:      "_CIRCLE",
+	PgTypeMacaddr8:       "MACADDR8",
+	PgTypeArrMacaddr8:    "_MACADDR8",
+	PgTypeMoney:          "MONEY",
+	PgTypeArrMoney:       "_MONEY",
+	PgTypeMacaddr:        "MACADDR",
+	PgTypeInet:           "INET",
+	PgTypeArrBool:        "_BOOL",
+	PgTypeArrBytea:       "_BYTEA",
+	PgTypeArrChar:        "_CHAR",
+	PgTypeArrName:        "_NAME",
+	PgTypeArrInt2:        "_INT2",
+	PgTypeArrInt4:        "_INT4",
+	PgTypeArrText:        "_TEXT",
+	PgTypeArrTid:         "_TID",
+	PgTypeArrXid:         "_XID",
+	PgTypeArrCid:         "_CID",
+	PgTypeArrBpchar:      "_BPCHAR",
+	PgTypeArrVarchar:     "_VARCHAR",
+	PgTypeArrInt8:        "_INT8",
+	PgTypeArrPoint:       "_POINT",
+	PgTypeArrLseg:        "_LSEG",
+	PgTypeArrPath:        "_PATH",
+	PgTypeArrBox:         "_BOX",
+	PgTypeArrFloat4:      "_FLOAT4",
+	PgTypeArrFloat8:      "_FLOAT8",
+	PgTypeArrPolygon:     "_POLYGON",
+	PgTypeArrOid:         "_OID",
+	PgTypeArrMacaddr:     "_MACADDR",
+	PgTypeArrInet:        "_INET",
+	PgTypeBpchar:         "BPCHAR",
+	PgTypeVarchar:        "VARCHAR",
+	PgTypeDate:           "DATE",
+	PgTypeTime:           "TIME",
+	PgTypeTimestamp:      "TIMESTAMP",
+	PgTypeArrTimestamp:   "_TIMESTAMP",
+	PgTypeArrDate:        "_DATE",
+	PgTypeArrTime:        "_TIME",
+	PgTypeTimestamptz:    "TIMESTAMP WITH TIME ZONE",
+	PgTypeArrTimestamptz: "_TIMESTAMPTZ",
+	PgTypeInterval:       "INTERVAL",
+	PgTypeArrInterval:    "_INTERVAL",
+	PgTypeArrNumeric:     "_NUMERIC",
+	PgTypeTimetz:         "TIME WITH TIME ZONE",
+	PgTypeArrTimetz:      "_TIMETZ",
+	PgTypeBit:            "BIT",
+	PgTypeArrBit:         "_BIT",
+	PgTypeVarbit:         "VARBIT",
+	PgTypeArrVarbit:      "_VARBIT",
+	PgTypeNumeric:        "NUMERIC",
+	PgTypeRefcursor:      "REFCURSOR",
+	PgTypeRegclass:       "REGCLASS",
+	PgTypeRegtype:        "REGTYPE",
+	PgTypeRecord:         "RECORD",
+	PgTypeCstring:        "CSTRING",
+	PgTypeVoid:           "VOID",
+	PgTypeUuid:           "UUID",
+	PgTypeArrUuid:        "_UUID",
+	PgTypeTxidSnapshot:   "TXID_SNAPSHOT",
+	PgTypePgLsn:          "PG_LSN",
+	PgTypeArrPgLsn:       "_PG_LSN",
+	PgTypeTsvector:       "TSVECTOR",
+	PgTypeTsquery:        "TSQUERY",
+	PgTypeArrTsvector:    "_TSVECTOR",
+	PgTypeArrTsquery:     "_TSQUERY",
+	PgTypeRegconfig:      "REGCONFIG",
+	PgTypeJsonb:          "JSONB",
+	PgTypeArrJsonb:       "_JSONB",
+	PgTypeInt4range:      "INT4RANGE",
+	PgTypeArrInt4range:   "_INT4RANGE",
+	PgTypeNumrange:       "NUMRANGE",
+	PgTypeArrNumrange:    "_NUMRANGE",
+	PgTypeTsrange:        "TSRANGE",
+	PgTypeArrTsrange:     "_TSRANGE",
+	PgTypeTstzrange:      "TSTZRANGE",
+	PgTypeArrTstzrange:   "_TSTZRANGE",
+	PgTypeDaterange:      "DATERANGE",
+	PgTypeArrDaterange:   "_DATERANGE",
+	PgTypeInt8range:      "INT8RANGE",
+	PgTypeArrInt8range:   "_INT8RANGE",
+	PgTypeRegnamespace:   "REGNAMESPACE",
+	PgTypeRegrole:        "REGROLE",
+}
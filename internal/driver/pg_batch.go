@@ -0,0 +1,118 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/blusewang/pg/internal/helper"
+	"github.com/blusewang/pg/internal/network"
+	"strconv"
+	"strings"
+)
+
+// 扩展协议中参数个数以 int16 表示
+const maxParameters = 65535
+
+// BatchInsert 以多行 VALUES 的单条 INSERT 批量写入 rows，超出数据源的 batch_size 时自动分批，返回写入的行数。
+// 每批使用未命名语句，不在连接上留下预备语句。各批次不在同一事务中，需要原子性时请在事务内调用
+func (c *PgConn) BatchInsert(ctx context.Context, tableName string, cols []string, rows [][]interface{}) (n int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.io.IOError != nil {
+		return 0, driver.ErrBadConn
+	}
+	if len(cols) == 0 {
+		return 0, nil
+	}
+	// 列数不符时参数会错位到相邻的行，提前检查
+	for j, r := range rows {
+		if len(r) != len(cols) {
+			return 0, fmt.Errorf("pg: batch insert row %d has %d values, want %d", j, len(r), len(cols))
+		}
+	}
+	var size = c.dsn.BatchSize
+	if size*len(cols) > maxParameters {
+		size = maxParameters / len(cols)
+	}
+	// 每批至少一行，否则无法推进
+	if size < 1 {
+		return 0, fmt.Errorf("pg: batch insert of %d columns with batch size %d exceeds the %d parameter limit", len(cols), c.dsn.BatchSize, maxParameters)
+	}
+	for len(rows) > 0 {
+		var batch = rows
+		if len(batch) > size {
+			batch = batch[:size]
+		}
+		rows = rows[len(batch):]
+
+		var args = make([]interface{}, 0, len(batch)*len(cols))
+		for _, r := range batch {
+			for _, v := range r {
+				var nv = driver.NamedValue{Ordinal: len(args) + 1, Value: v}
+				if err = c.CheckNamedValue(&nv); err != nil {
+					return
+				}
+				args = append(args, nv.Value)
+			}
+		}
+		query, err := batchInsertQuery(tableName, cols, len(batch))
+		if err != nil {
+			return n, err
+		}
+		counts, err := c.io.ParseAndExecBatch(ctx, []network.BatchStmt{{SQL: query, Args: args}})
+		if e, ok := err.(*network.BatchError); ok {
+			return n, e.Err
+		}
+		if err != nil {
+			return n, err
+		}
+		n += int64(counts[0])
+	}
+	return
+}
+
+// insert into "t" ("a", "b") values ($1, $2), ($3, $4)
+func batchInsertQuery(tableName string, cols []string, rowCount int) (string, error) {
+	table, err := quoteQualifiedName(tableName)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString("insert into ")
+	b.WriteString(table)
+	b.WriteString(" (")
+	for i, col := range cols {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		quoted, err := helper.QuoteIdentifier(col)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(quoted)
+	}
+	b.WriteString(") values ")
+	var p = 0
+	for r := 0; r < rowCount; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for i := range cols {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			p++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(p))
+		}
+		b.WriteByte(')')
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/blusewang/pg/internal/network"
+	"testing"
+	"time"
+)
+
+func TestBatchInsertQuery(t *testing.T) {
+	q, err := batchInsertQuery("public.t", []string{"id", "name"}, 2)
+	if err != nil || q != `insert into "public"."t" ("id", "name") values ($1, $2), ($3, $4)` {
+		t.Fatal(q, err)
+	}
+	if _, err = batchInsertQuery("t", []string{"a\x00b"}, 1); err != network.ErrNulInString {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchInsertUnnamed(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+
+	n, err := c.BatchInsert(context.Background(), "t", []string{"a", "b"}, [][]interface{}{{"x", 1}})
+	if err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if len(c.stmts) != 0 {
+		t.Fatal("BatchInsert must not leave prepared statements behind:", len(c.stmts))
+	}
+	if _, err = c.BatchInsert(context.Background(), "t", []string{"a", "b"}, [][]interface{}{{"x", 1}, {"y"}}); err == nil {
+		t.Fatal("a row with fewer values than cols must be rejected")
+	}
+}
+
+// 每批容不下一行时报错，而不是无限循环
+func TestBatchInsertSize(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+
+	var cols = make([]string, maxParameters+1)
+	var row = make([]interface{}, len(cols))
+	for i := range cols {
+		cols[i] = fmt.Sprint("c", i)
+	}
+	if _, err := c.BatchInsert(context.Background(), "t", cols, [][]interface{}{row}); err == nil {
+		t.Fatal("more columns than parameters must be rejected")
+	}
+	c.dsn.BatchSize = 0
+	if _, err := c.BatchInsert(context.Background(), "t", []string{"a"}, [][]interface{}{{1}}); err == nil {
+		t.Fatal("zero batch size must be rejected")
+	}
+	// 每条连接按自己的数据源分批
+	c.dsn.BatchSize = 1
+	n, err := c.BatchInsert(context.Background(), "t", []string{"a"}, [][]interface{}{{1}, {2}, {3}})
+	if err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestBatchInsert(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	if _, _, _, err := c.io.QueryNoArgs("create temp table batch_insert (id int8, name text)"); err != nil {
+		t.Fatal(err)
+	}
+	var rows = make([][]interface{}, 10000)
+	for i := range rows {
+		rows[i] = []interface{}{i, "name"}
+	}
+	var start = time.Now()
+	n, err := c.BatchInsert(context.Background(), "batch_insert", []string{"id", "name"}, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(rows)) {
+		t.Fatal(n)
+	}
+	var batch = time.Since(start)
+
+	st, err := NewPgStmt(c, "insert into batch_insert (id, name) values ($1, $2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	for i := range rows {
+		if _, err = st.ExecContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: int64(i)}, {Ordinal: 2, Value: "name"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Logf("%d rows: BatchInsert %v, individual inserts %v", len(rows), batch, time.Since(start))
+}
+
+func TestParseAndExecBatchRollback(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	if _, _, err := c.io.QueryNoArgsExec("create temp table batch_exec (id int8 primary key)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.io.QueryNoArgsExec("begin"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.io.ParseAndExecBatch(context.Background(), []network.BatchStmt{
+		{SQL: "insert into batch_exec values ($1)", Args: []interface{}{int64(1)}},
+		{SQL: "insert into batch_exec values ($1)", Args: []interface{}{int64(1)}},
+	})
+	if _, ok := err.(*network.BatchError); !ok {
+		t.Fatal(err)
+	}
+	if err = c.io.RecoverFromFailedTransaction(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_, _, data, err := c.io.QueryNoArgs("select count(*) from batch_exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := string((*data)[0][0]); n != "0" {
+		t.Fatal("the first insert was not rolled back:", n)
+	}
+}
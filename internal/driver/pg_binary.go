@@ -0,0 +1,56 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"github.com/blusewang/pg/internal/network"
+)
+
+// binaryDecoders 可按二进制格式接收的类型及其解码函数，解码结果与文本格式一致。
+// 扩展查询中这些类型的结果列以二进制格式请求，省去服务端的文本编码及客户端的解析。
+// 非严格模式下 NULL 以空值传入，返回零值
+var binaryDecoders = map[PgType]func(raw []byte) driver.Value{
+	PgTypeBool: func(raw []byte) driver.Value {
+		return len(raw) == 1 && raw[0] != 0
+	},
+	PgTypeInt2: func(raw []byte) driver.Value {
+		if len(raw) != 2 {
+			return 0
+		}
+		return int(int16(binary.BigEndian.Uint16(raw)))
+	},
+	PgTypeInt4: func(raw []byte) driver.Value {
+		if len(raw) != 4 {
+			return 0
+		}
+		return int(int32(binary.BigEndian.Uint32(raw)))
+	},
+	PgTypeInt8: func(raw []byte) driver.Value {
+		if len(raw) != 8 {
+			return 0
+		}
+		return int(int64(binary.BigEndian.Uint64(raw)))
+	},
+}
+
+// resultFormats 为有二进制解码函数的列选择二进制格式，并记入 cols 的 FormatCode。
+// 没有这样的列时返回 nil，全部使用文本格式
+func resultFormats(cols []network.PgColumn) (formats []uint16) {
+	for i := range cols {
+		if binaryDecoders[PgType(cols[i].TypeOid)] == nil {
+			continue
+		}
+		if formats == nil {
+			formats = make([]uint16, len(cols))
+		}
+		formats[i] = network.FormatBinary
+		cols[i].FormatCode = network.FormatBinary
+	}
+	return
+}
@@ -8,6 +8,7 @@ package driver
 
 import (
 	"context"
+	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,7 +29,7 @@ func NewPgConn(name string) (c *PgConn, err error) {
 	}
 
 	c.io = network.NewPgIO(c.dsn)
-	err = c.io.Dial(c.dsn.Address())
+	err = c.io.DialDSN()
 	if err != nil {
 		return
 	}
@@ -36,6 +38,7 @@ func NewPgConn(name string) (c *PgConn, err error) {
 		return
 	}
 	c.stmts = make(map[string]*PgStmt)
+	c.types = new(typeCache)
 	return
 }
 
@@ -52,11 +55,12 @@ func NewPgConnContext(ctx context.Context, name string) (c *PgConn, err error) {
 	if err != nil {
 		return
 	}
-	err = c.io.StartUp()
+	err = c.io.StartUpContext(ctx)
 	if err != nil {
 		return
 	}
 	c.stmts = make(map[string]*PgStmt)
+	c.types = new(typeCache)
 	return
 }
 
@@ -64,14 +68,51 @@ type PgConn struct {
 	dsn   *helper.DataSourceName
 	io    *network.PgIO
 	stmts map[string]*PgStmt
+	types *typeCache
+	// 串行化本连接上的请求。各 PgStmt 共用同一个 PgIO，可被多个 goroutine 同时使用，
+	// 每次往返须在持有该锁时完成，stmts 也由它保护
+	mu sync.Mutex
 }
 
 // Prepare returns a prepared statement, bound to this connection.
 func (c *PgConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareSession(query)
+}
+
+// PrepareSession 返回在本连接上命名并缓存的预备语句，相同的 query 共享同一个语句。
+// 每次调用都需要对应一次 Close，最后一次 Close 时才在服务端关闭该语句
+func (c *PgConn) PrepareSession(query string) (*PgStmt, error) {
 	if c.io.IOError != nil {
 		return nil, driver.ErrBadConn
 	}
-	return NewPgStmt(c, query)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, err := NewPgStmt(c, query)
+	if err != nil {
+		return nil, err
+	}
+	st.refs++
+	return st, nil
+}
+
+// SetNoticeHandler 设置服务端 NOTICE、WARNING 等提示的处理函数，为 nil 时丢弃。
+// 可通过 sql.Conn.Raw 取得 PgConn 后设置，并发调用是安全的
+func (c *PgConn) SetNoticeHandler(fn func(*network.PgError)) {
+	c.io.SetNoticeHandler(fn)
+}
+
+// ResetSession 连接池复用连接前调用。上一个使用者留下失败的事务时先 ROLLBACK，
+// 无法恢复时返回 driver.ErrBadConn，由连接池丢弃该连接
+func (c *PgConn) ResetSession(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.io.IOError != nil {
+		return driver.ErrBadConn
+	}
+	if err := c.io.RecoverFromFailedTransaction(ctx); err != nil {
+		return driver.ErrBadConn
+	}
+	return nil
 }
 
 // Close invalidates and potentially stops any current
@@ -83,6 +124,12 @@ func (c *PgConn) Prepare(query string) (driver.Stmt, error) {
 // idle connections, it shouldn't be necessary for drivers to
 // do their own connection caching.
 func (c *PgConn) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.types != nil && c.types.stop != nil {
+		close(c.types.stop)
+		c.types.stop = nil
+	}
 	err = c.io.Terminate()
 	return
 }
@@ -91,29 +138,114 @@ func (c *PgConn) Close() (err error) {
 //
 // Deprecated: Drivers should implement ConnBeginTx instead (or additionally).
 func (c *PgConn) Begin() (_ driver.Tx, err error) {
+	return c.begin("begin")
+}
+
+// BeginTx starts and returns a new transaction.
+// If the context is canceled by the user the sql package will
+// call Tx.Rollback before discarding and closing the connection.
+//
+// This must check opts.Isolation to determine if there is a set
+// isolation level. If the driver does not support a non-default
+// level and one is set or if there is a non-default isolation level
+// that is not supported, an error must be returned.
+//
+// This must also check opts.ReadOnly to determine if the read-only
+// value is true to either set the read-only transaction property if supported
+// or return an error if it is not supported.
+func (c *PgConn) BeginTx(ctx context.Context, opts driver.TxOptions) (_ driver.Tx, err error) {
+	var query = "begin"
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelDefault:
+	case sql.LevelReadUncommitted:
+		query += " isolation level read uncommitted"
+	case sql.LevelReadCommitted:
+		query += " isolation level read committed"
+	case sql.LevelRepeatableRead:
+		query += " isolation level repeatable read"
+	case sql.LevelSerializable:
+		query += " isolation level serializable"
+	default:
+		return nil, fmt.Errorf("pg: isolation level not supported: %v", sql.IsolationLevel(opts.Isolation))
+	}
+	if opts.ReadOnly {
+		query += " read only"
+	}
+	return c.begin(query)
+}
+
+func (c *PgConn) begin(query string) (_ driver.Tx, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.io.IOError != nil {
 		return nil, driver.ErrBadConn
 	}
 	if c.io.IsInTransaction() {
-		err = errors.New("this connection is in transaction")
+		return nil, errors.New("this connection is in transaction")
 	}
-	_, _, _, err = c.io.QueryNoArgs("begin")
+	_, _, _, err = c.io.QueryNoArgs(query)
 	if err != nil {
 		return
 	}
 	if !c.io.IsInTransaction() {
-		err = errors.New("begin fail")
+		return nil, errors.New("begin fail")
 	}
-
 	return &PgTx{pgConn: c}, nil
 }
 
+// ExecContext 不带参数时以简单查询协议执行，query 可以包含多条语句，返回各语句影响行数之和。
+// 带参数时返回 driver.ErrSkip，由 database/sql 改用预备语句执行
+func (c *PgConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if len(args) > 0 {
+		return nil, driver.ErrSkip
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.io.IOError != nil {
+		return nil, driver.ErrBadConn
+	}
+	defer c.io.WatchCancel(ctx)()
+	n, err := c.io.QueryNoArgsMultiExec(query)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
 func (c *PgConn) Query(query string, args []driver.Value) (_ driver.Rows, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	stmt, err := NewPgStmt(c, query)
 	if err != nil {
 		return nil, err
 	}
-	return stmt.Query(args)
+	var as = make([]interface{}, len(args))
+	for i, v := range args {
+		as[i] = v
+	}
+	return stmt.query(context.Background(), as)
+}
+
+// QueryMulti 以简单查询协议执行不带参数的 query。query 可以包含多条语句，
+// 各语句的结果依次作为一个结果集，通过 NextResultSet 读取。可通过 sql.Conn.Raw 取得 PgConn 后调用
+func (c *PgConn) QueryMulti(ctx context.Context, query string) (_ driver.Rows, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.io.IOError != nil {
+		return nil, driver.ErrBadConn
+	}
+	defer c.io.WatchCancel(ctx)()
+	sets, err := c.io.QueryNoArgsMulti(query)
+	if err != nil {
+		return nil, err
+	}
+	var pr = new(PgRows)
+	pr.isStrict = c.dsn.IsStrict
+	pr.location = c.io.Location
+	pr.types = c.types
+	pr.setResult(sets[0])
+	pr.sets = sets[1:]
+	return pr, nil
 }
 
 // NamedValueChecker可以可选地由Conn或Stmt实现。 它为驱动程序提供了更多控制来处理Go和数据库类型，超出了允许的默认值类型。
@@ -230,13 +362,16 @@ func (c *PgConn) CheckNamedValue(nv *driver.NamedValue) error {
 	// time
 	case time.Time:
 	case *time.Time:
+		nv.Value = *nv.Value.(*time.Time)
+
+	// tid
+	case TID:
+		nv.Value = nv.Value.(TID).String()
+	case *TID:
+		nv.Value = nv.Value.(*TID).String()
 
 	default:
 		nv.Value = fmt.Sprintf("%v", nv.Value)
 	}
 	return nil
 }
-
-func (c *PgConn) cancel() {
-	_ = c.io.CancelRequest()
-}
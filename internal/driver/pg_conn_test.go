@@ -0,0 +1,169 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在 PG_DSN 的基础上追加一个参数
+func testDSNWith(t *testing.T, key, value string) string {
+	var dsn = os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PG_DSN not set")
+	}
+	switch {
+	case !strings.Contains(dsn, "://"):
+		return dsn + " " + key + "='" + strings.Replace(value, "'", `\'`, -1) + "'"
+	case strings.Contains(dsn, "?"):
+		return dsn + "&" + key + "=" + url.QueryEscape(value)
+	default:
+		return dsn + "?" + key + "=" + url.QueryEscape(value)
+	}
+}
+
+func testShow(t *testing.T, dsn, query string) string {
+	c, err := NewPgConn(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, _, data, err := c.io.QueryNoArgs(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string((*data)[0][0])
+}
+
+func TestSearchPath(t *testing.T) {
+	var dsn = testDSNWith(t, "search_path", "pg_catalog")
+	if v := testShow(t, dsn, "select current_schema()"); v != "pg_catalog" {
+		t.Fatal(v)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var dsn = testDSNWith(t, "options", "-c default_transaction_isolation=serializable")
+	if v := testShow(t, dsn, "show default_transaction_isolation"); v != "serializable" {
+		t.Fatal(v)
+	}
+}
+
+func TestBeginTxIsolation(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	var levels = map[sql.IsolationLevel]string{
+		sql.LevelReadUncommitted: "read uncommitted",
+		sql.LevelReadCommitted:   "read committed",
+		sql.LevelRepeatableRead:  "repeatable read",
+		sql.LevelSerializable:    "serializable",
+	}
+	for level, want := range levels {
+		tx, err := c.BeginTx(context.Background(), driver.TxOptions{Isolation: driver.IsolationLevel(level), ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, data, err := c.io.QueryNoArgs("select current_setting('transaction_isolation'), current_setting('transaction_read_only')")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string((*data)[0][0]) != want || string((*data)[0][1]) != "on" {
+			t.Fatal(level, string((*data)[0][0]), string((*data)[0][1]))
+		}
+		if err = tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.BeginTx(context.Background(), driver.TxOptions{Isolation: driver.IsolationLevel(sql.LevelLinearizable)}); err == nil {
+		t.Fatal("linearizable must be rejected")
+	}
+}
+
+func TestResetSessionFailedTransaction(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	if _, _, err := c.io.QueryNoArgsExec("begin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.io.QueryNoArgsExec("select 1 / 0"); err == nil {
+		t.Fatal("division by zero")
+	}
+	if err := c.ResetSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.io.IsInTransaction() {
+		t.Fatal("still in the failed transaction")
+	}
+	if _, _, err := c.io.QueryNoArgsExec("select 1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecContextMultiStatement(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+
+	res, err := c.ExecContext(context.Background(), "insert into t values (1); insert into t values (2)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Fatal(n)
+	}
+	if _, err = c.ExecContext(context.Background(), "insert into t values ($1)", []driver.NamedValue{{Ordinal: 1, Value: int64(1)}}); err != driver.ErrSkip {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryMulti(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	rows, err := c.QueryMulti(context.Background(), "select 1; select 'a', 'b'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var dest = make([]driver.Value, 2)
+	if err = rows.Next(dest[:1]); err != nil || dest[0] != int64(1) {
+		t.Fatal(dest[0], err)
+	}
+	var multi = rows.(driver.RowsNextResultSet)
+	if !multi.HasNextResultSet() {
+		t.Fatal("the second statement has a result set")
+	}
+	if err = multi.NextResultSet(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows.Columns()) != 2 {
+		t.Fatal(rows.Columns())
+	}
+}
+
+func TestCheckNamedValueTimePointer(t *testing.T) {
+	var c = new(PgConn)
+	var now = time.Now()
+	var nv = driver.NamedValue{Ordinal: 1, Value: &now}
+	if err := c.CheckNamedValue(&nv); err != nil || nv.Value != now {
+		t.Fatal(nv.Value, err)
+	}
+	var null *time.Time
+	nv = driver.NamedValue{Ordinal: 1, Value: null}
+	if err := c.CheckNamedValue(&nv); err != nil || nv.Value != nil {
+		t.Fatal(nv.Value, err)
+	}
+}
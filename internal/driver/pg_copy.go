@@ -0,0 +1,75 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/blusewang/pg/internal/helper"
+	"github.com/blusewang/pg/internal/network"
+	"strings"
+)
+
+// CopyFromRows 通过 COPY 协议批量写入 rows，返回写入的行数。
+// 每个值与查询参数一样经 CheckNamedValue 转换，nil 写为 NULL。
+func (c *PgConn) CopyFromRows(ctx context.Context, tableName string, cols []string, rows [][]interface{}) (n int64, err error) {
+	if c.io.IOError != nil {
+		return 0, driver.ErrBadConn
+	}
+	var buf []byte
+	var row = make([]interface{}, len(cols))
+	for j, r := range rows {
+		// 列数不符时服务端要到 COPY 中途才报错，提前检查
+		if len(r) != len(cols) {
+			return 0, fmt.Errorf("pg: copy row %d has %d values, want %d", j, len(r), len(cols))
+		}
+		for i, v := range r {
+			var nv = driver.NamedValue{Ordinal: i + 1, Value: v}
+			if err = c.CheckNamedValue(&nv); err != nil {
+				return
+			}
+			row[i] = nv.Value
+		}
+		buf = network.AppendCopyText(buf, row)
+	}
+
+	query, err := copyFromQuery(tableName, cols)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.io.WatchCancel(ctx)()
+	return c.io.CopyFrom(query, bytes.NewReader(buf))
+}
+
+func copyFromQuery(tableName string, cols []string) (_ string, err error) {
+	var quoted = make([]string, len(cols))
+	for i, col := range cols {
+		if quoted[i], err = helper.QuoteIdentifier(col); err != nil {
+			return
+		}
+	}
+	table, err := quoteQualifiedName(tableName)
+	if err != nil {
+		return
+	}
+	return "copy " + table + " (" + strings.Join(quoted, ", ") + ") from stdin", nil
+}
+
+// 表名可带模式名，如 public.users
+func quoteQualifiedName(name string) (_ string, err error) {
+	var parts = strings.Split(name, ".")
+	for i, part := range parts {
+		if parts[i], err = helper.QuoteIdentifier(part); err != nil {
+			return
+		}
+	}
+	return strings.Join(parts, "."), nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"fmt"
+	"github.com/blusewang/pg/internal/network"
+	"io"
+)
+
+// CopyCSVOptions CSV 的解析选项
+type CopyCSVOptions struct {
+	// 字段分隔符，默认为 ','
+	Delimiter rune
+	// 引号字符，encoding/csv 只支持 '"'，0 表示默认
+	Quote rune
+	// 与之相等的字段写为 NULL，默认空字段为 NULL
+	Null string
+	// 首行为表头，按表头把列对应到 cols
+	Header bool
+}
+
+// CopyFromCSV 读取 r 中的 CSV，转为 COPY 文本格式后通过 COPY 协议写入，返回写入的行数。
+// CSV 格式错误时中止 COPY，错误信息中带有 CSV 的行号
+func (c *PgConn) CopyFromCSV(ctx context.Context, table string, cols []string, r io.Reader, opts CopyCSVOptions) (n int64, err error) {
+	if c.io.IOError != nil {
+		return 0, driver.ErrBadConn
+	}
+	if opts.Quote != 0 && opts.Quote != '"' {
+		return 0, fmt.Errorf("pg: csv quote character %q not supported", opts.Quote)
+	}
+	query, err := copyFromQuery(table, cols)
+	if err != nil {
+		return
+	}
+	var cr = csv.NewReader(r)
+	if opts.Delimiter != 0 {
+		cr.Comma = opts.Delimiter
+	}
+	cr.ReuseRecord = true
+
+	var index []int
+	if opts.Header {
+		header, err := cr.Read()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("pg: %v", err)
+		}
+		if index, err = csvColumnIndex(header, cols); err != nil {
+			return 0, err
+		}
+	} else {
+		cr.FieldsPerRecord = len(cols)
+		index = make([]int, len(cols))
+		for i := range index {
+			index[i] = i
+		}
+	}
+
+	var pr, pw = io.Pipe()
+	var done = make(chan error, 1)
+	go func() {
+		var err = encodeCSV(cr, pw, index, opts.Null)
+		_ = pw.CloseWithError(err)
+		done <- err
+	}()
+
+	func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		defer c.io.WatchCancel(ctx)()
+		n, err = c.io.CopyFrom(query, pr)
+	}()
+	// 提前返回时关闭读端，使编码协程退出
+	_ = pr.Close()
+	if csvErr := <-done; csvErr != nil && csvErr != io.ErrClosedPipe {
+		return 0, csvErr
+	}
+	return
+}
+
+// 表头中每个 cols 所在的位置
+func csvColumnIndex(header []string, cols []string) ([]int, error) {
+	var pos = make(map[string]int, len(header))
+	for i, name := range header {
+		if _, has := pos[name]; has {
+			return nil, fmt.Errorf("pg: csv line 1: duplicate column %q in header", name)
+		}
+		pos[name] = i
+	}
+	var index = make([]int, len(cols))
+	for i, col := range cols {
+		p, has := pos[col]
+		if !has {
+			return nil, fmt.Errorf("pg: csv line 1: column %q not found in header", col)
+		}
+		index[i] = p
+	}
+	return index, nil
+}
+
+func encodeCSV(cr *csv.Reader, w io.Writer, index []int, null string) error {
+	var bw = bufio.NewWriterSize(w, 64*1024)
+	var row = make([]interface{}, len(index))
+	var buf []byte
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("pg: %v", err)
+		}
+		for i, p := range index {
+			if record[p] == null {
+				row[i] = nil
+			} else {
+				row[i] = record[p]
+			}
+		}
+		buf = network.AppendCopyText(buf[:0], row)
+		if _, err = bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
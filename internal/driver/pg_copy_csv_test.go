@@ -0,0 +1,68 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"strings"
+	"testing"
+)
+
+func TestEncodeCSV(t *testing.T) {
+	var cr = csv.NewReader(strings.NewReader("name,id\n\"a\tb\",1\n\"c\\d\ne\",2\n,3\n"))
+	header, err := cr.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := csvColumnIndex(header, []string{"id", "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = encodeCSV(cr, &buf, index, ""); err != nil {
+		t.Fatal(err)
+	}
+	if v := buf.String(); v != "1\ta\\tb\n2\tc\\\\d\\ne\n3\t\\N\n" {
+		t.Fatalf("%q", v)
+	}
+
+	if _, err = csvColumnIndex(header, []string{"id", "email"}); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatal(err)
+	}
+
+	cr = csv.NewReader(strings.NewReader("1,a\n2,b\n3\n"))
+	cr.FieldsPerRecord = 2
+	if err = encodeCSV(cr, &buf, []int{0, 1}, ""); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyFromCSV(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	if _, _, _, err := c.io.QueryNoArgs("create temp table copy_csv (id int8, name text)"); err != nil {
+		t.Fatal(err)
+	}
+	var opts = CopyCSVOptions{Delimiter: ';', Null: "NULL", Header: true}
+	n, err := c.CopyFromCSV(context.Background(), "copy_csv", []string{"id", "name"}, strings.NewReader("name;id\nx;1\nNULL;2\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal(n)
+	}
+	_, err = c.CopyFromCSV(context.Background(), "copy_csv", []string{"id", "name"}, strings.NewReader("name;id\ny;3\nz\n"), opts)
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatal(err)
+	}
+	if c.io.IOError != nil {
+		t.Fatal(c.io.IOError)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"context"
+	"github.com/blusewang/pg/internal/network"
+	"strings"
+	"testing"
+)
+
+func TestCopyFromRowsLength(t *testing.T) {
+	var c = &PgConn{io: network.NewPgIO(nil)}
+	for _, rows := range [][][]interface{}{
+		{{int64(1), "a"}, {int64(2), "b", "c"}},
+		{{int64(1), "a"}, {int64(2)}},
+	} {
+		_, err := c.CopyFromRows(context.Background(), "t", []string{"id", "name"}, rows)
+		if err == nil || !strings.Contains(err.Error(), "row 1") {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/blusewang/pg/internal/helper"
+	"github.com/blusewang/pg/internal/network"
+)
+
+// PgCursor 服务端游标，分批获取大结果集，避免一次性全部读入内存。
+// 游标只在声明它的事务内有效。
+type PgCursor struct {
+	pgConn *PgConn
+	name   string
+}
+
+// OpenCursor 以扩展协议执行 DECLARE name CURSOR FOR query，参数按 $n 绑定。
+// 使用未命名语句，不在连接上留下预备语句
+func (c *PgConn) OpenCursor(ctx context.Context, name, query string, args []interface{}) (*PgCursor, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.io.IOError != nil {
+		return nil, driver.ErrBadConn
+	}
+	if !c.io.IsInTransaction() {
+		return nil, errors.New("pg: cursor must be opened inside a transaction")
+	}
+	quoted, err := helper.QuoteIdentifier(name)
+	if err != nil {
+		return nil, err
+	}
+	var cur = &PgCursor{pgConn: c, name: quoted}
+	var as = make([]interface{}, len(args))
+	for i, v := range args {
+		var nv = driver.NamedValue{Ordinal: i + 1, Value: v}
+		if err := c.CheckNamedValue(&nv); err != nil {
+			return nil, err
+		}
+		as[i] = nv.Value
+	}
+	_, err = c.io.ParseAndExecBatch(ctx, []network.BatchStmt{{SQL: "declare " + cur.name + " cursor for " + query, Args: as}})
+	if e, ok := err.(*network.BatchError); ok {
+		return nil, e.Err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+// Fetch 获取接下来的 n 行
+func (cur *PgCursor) Fetch(n int) (driver.Rows, error) {
+	return cur.fetch(fmt.Sprintf("fetch %d from %s", n, cur.name))
+}
+
+// FetchAll 获取剩余的所有行
+func (cur *PgCursor) FetchAll() (driver.Rows, error) {
+	return cur.fetch("fetch all from " + cur.name)
+}
+
+func (cur *PgCursor) Close() (err error) {
+	cur.pgConn.mu.Lock()
+	defer cur.pgConn.mu.Unlock()
+	if cur.pgConn.io.IOError != nil {
+		return driver.ErrBadConn
+	}
+	_, _, _, err = cur.pgConn.io.QueryNoArgs("close " + cur.name)
+	return
+}
+
+func (cur *PgCursor) fetch(query string) (_ driver.Rows, err error) {
+	cur.pgConn.mu.Lock()
+	defer cur.pgConn.mu.Unlock()
+	if cur.pgConn.io.IOError != nil {
+		return nil, driver.ErrBadConn
+	}
+	var pr = new(PgRows)
+	pr.isStrict = cur.pgConn.dsn.IsStrict
+	pr.location = cur.pgConn.io.Location
+	pr.types = cur.pgConn.types
+	pr.columns, pr.fieldLen, pr.rows, err = cur.pgConn.io.QueryNoArgs(query)
+	if err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
@@ -26,8 +26,14 @@ func convert(raw []byte, col network.PgColumn, fieldLen uint32, location *time.L
 		// is nil
 		return nil
 	}
-	if col.Format != 0 {
-		panic("not support binary data")
+	if col.FormatCode == network.FormatBinary {
+		if decode := binaryDecoders[PgType(col.TypeOid)]; decode != nil {
+			return decode(raw)
+		}
+		// 二进制格式不能按文本解码，原样返回
+		var b = make([]byte, len(raw))
+		copy(b, raw)
+		return b
 	}
 
 	switch PgType(col.TypeOid) {
@@ -54,6 +60,12 @@ func convert(raw []byte, col network.PgColumn, fieldLen uint32, location *time.L
 		return f
 	case PgTypeJson, PgTypeJsonb, PgTypeUuid, PgTypePoint:
 		return string(raw)
+	case PgTypeTid:
+		var t, _ = parseTid(raw)
+		return t
+	case PgTypeOid:
+		var n, _ = strconv.ParseUint(string(raw), 10, 32)
+		return uint32(n)
 	case PgTypeArrInt4:
 		var str = string(raw)
 		var arr []int64
@@ -89,6 +101,140 @@ func convert(raw []byte, col network.PgColumn, fieldLen uint32, location *time.L
 	}
 }
 
+// 字符串参数对应数值类型时，在客户端转换为规范的十进制文本并校验范围。
+// 无效的值在发送前即被拒绝，不会使所在事务进入中止状态；0x、0o、0b 前缀的整数也能用于 PG 16 之前的版本。
+// serverMajor 为服务端主版本号，未知时为 0
+func coerceArg(oid uint32, arg interface{}, serverMajor int) (interface{}, error) {
+	var str, ok = arg.(string)
+	if !ok {
+		return arg, nil
+	}
+	var s = strings.TrimSpace(str)
+	switch PgType(oid) {
+	case PgTypeInt2, PgTypeInt4, PgTypeInt8:
+		if n, err := parseIntLiteral(s, intBitSize[PgType(oid)]); err == nil {
+			return n, nil
+		}
+	case PgTypeFloat4, PgTypeFloat8:
+		var bits = 64
+		if PgType(oid) == PgTypeFloat4 {
+			bits = 32
+		}
+		if f, err := strconv.ParseFloat(s, bits); err == nil {
+			return f, nil
+		}
+	case PgTypeNumeric:
+		// numeric 精度任意，只校验语法，按原文发送以免丢失精度
+		if isNumericLiteral(s, serverMajor == 0 || serverMajor >= 14) {
+			return s, nil
+		}
+	default:
+		return arg, nil
+	}
+	return nil, fmt.Errorf("pg: parameter %q is not a valid %v", str, pgTypeNames[PgType(oid)])
+}
+
+var intBitSize = map[PgType]int{PgTypeInt2: 16, PgTypeInt4: 32, PgTypeInt8: 64}
+
+// 十进制整数，或带 0x、0o、0b 前缀的整数。不按 Go 的规则把前导 0 视为八进制
+func parseIntLiteral(s string, bits int) (int64, error) {
+	var digits = strings.TrimLeft(s, "+-")
+	if len(digits) > 2 && digits[0] == '0' && strings.ContainsRune("xXoObB", rune(digits[1])) {
+		return strconv.ParseInt(s, 0, bits)
+	}
+	return strconv.ParseInt(s, 10, bits)
+}
+
+// 与 numeric_in 接受的写法一致：[+-]digits[.digits][e[+-]digits]，以及 NaN；
+// infinity 为 true 时还接受 Infinity（PG 14 起）
+func isNumericLiteral(s string, infinity bool) bool {
+	if strings.EqualFold(s, "nan") {
+		return true
+	}
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	if strings.EqualFold(s, "infinity") || strings.EqualFold(s, "inf") {
+		return infinity
+	}
+	var digits, dot = 0, false
+	var i = 0
+	for ; i < len(s); i++ {
+		if c := s[i]; c >= '0' && c <= '9' {
+			digits++
+		} else if c == '.' && !dot {
+			dot = true
+		} else {
+			break
+		}
+	}
+	if digits == 0 {
+		return false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		var start = i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == start {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
+// TID 对应PG的 tid 类型，表示行的物理位置 (block,offset)，即 ctid
+type TID struct {
+	Block  uint32
+	Offset uint16
+}
+
+func (t TID) String() string {
+	return fmt.Sprintf("(%d,%d)", t.Block, t.Offset)
+}
+
+// Scan implements the sql.Scanner interface.
+func (t *TID) Scan(src interface{}) (err error) {
+	switch v := src.(type) {
+	case TID:
+		*t = v
+	case []byte:
+		*t, err = parseTid(v)
+	case string:
+		*t, err = parseTid([]byte(v))
+	default:
+		err = fmt.Errorf("pg: cannot scan %T into TID", src)
+	}
+	return
+}
+
+// 解析 tid 的文本格式：(block,offset)
+func parseTid(raw []byte) (t TID, err error) {
+	var str = string(raw)
+	if len(str) < 5 || str[0] != '(' || str[len(str)-1] != ')' {
+		return t, fmt.Errorf("invalid tid %q", str)
+	}
+	var parts = strings.Split(str[1:len(str)-1], ",")
+	if len(parts) != 2 {
+		return t, fmt.Errorf("invalid tid %q", str)
+	}
+	block, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return t, fmt.Errorf("invalid tid %q", str)
+	}
+	offset, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return t, fmt.Errorf("invalid tid %q", str)
+	}
+	t.Block = uint32(block)
+	t.Offset = uint16(offset)
+	return t, nil
+}
+
 type pgStringArr struct {
 	Raw      []rune
 	position int
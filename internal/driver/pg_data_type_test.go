@@ -0,0 +1,135 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"database/sql/driver"
+	"github.com/blusewang/pg/internal/network"
+	"math"
+	"testing"
+)
+
+func TestParseTid(t *testing.T) {
+	tid, err := parseTid([]byte("(4294967295,65535)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tid.Block != 4294967295 || tid.Offset != 65535 {
+		t.Fatal(tid)
+	}
+	if tid.String() != "(4294967295,65535)" {
+		t.Fatal(tid.String())
+	}
+	for _, s := range []string{"", "()", "(1)", "(1,2", "(a,1)", "(1,65536)"} {
+		if _, err = parseTid([]byte(s)); err == nil {
+			t.Fatalf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestCoerceArg(t *testing.T) {
+	var cases = []struct {
+		oid  uint32
+		in   string
+		want interface{}
+	}{
+		{PgTypeInt4, "42", int64(42)},
+		{PgTypeInt4, " -42 ", int64(-42)},
+		{PgTypeInt4, "0x2A", int64(42)},
+		{PgTypeInt4, "010", int64(10)},
+		{PgTypeInt8, "9223372036854775807", int64(math.MaxInt64)},
+		{PgTypeFloat8, "1.5", 1.5},
+		{PgTypeFloat8, "1e3", 1000.0},
+		{PgTypeNumeric, " 12345678901234567890.123 ", "12345678901234567890.123"},
+		{PgTypeNumeric, "-1.5e-3", "-1.5e-3"},
+		{PgTypeNumeric, "NaN", "NaN"},
+		{PgTypeNumeric, "-Infinity", "-Infinity"},
+		{PgTypeText, " abc", " abc"},
+	}
+	for _, c := range cases {
+		v, err := coerceArg(c.oid, c.in, 0)
+		if err != nil || v != c.want {
+			t.Fatal(c.in, v, err)
+		}
+	}
+	var invalid = []struct {
+		oid uint32
+		in  string
+	}{
+		{PgTypeInt8, "abc"},
+		{PgTypeInt4, "1.5"},
+		{PgTypeInt2, "70000"},
+		{PgTypeInt4, ""},
+		{PgTypeFloat4, "1e300"},
+		{PgTypeFloat8, "1,5"},
+		{PgTypeNumeric, "1e"},
+		{PgTypeNumeric, "."},
+		{PgTypeNumeric, "-NaN"},
+		{PgTypeNumeric, "12abc"},
+	}
+	for _, c := range invalid {
+		if _, err := coerceArg(c.oid, c.in, 16); err == nil {
+			t.Fatalf("%q should be rejected for %v", c.in, pgTypeNames[PgType(c.oid)])
+		}
+	}
+	// 非字符串参数原样传递
+	if v, err := coerceArg(PgTypeInt4, int64(7), 0); err != nil || v != int64(7) {
+		t.Fatal(v, err)
+	}
+	// numeric 的 Infinity 自 PG 14 起才支持
+	if _, err := coerceArg(PgTypeNumeric, "Infinity", 13); err == nil {
+		t.Fatal("numeric infinity must be rejected before 14")
+	}
+	if v, err := coerceArg(PgTypeNumeric, "-inf", 14); err != nil || v != "-inf" {
+		t.Fatal(v, err)
+	}
+}
+
+func TestConvertOid(t *testing.T) {
+	var raw = []byte("4294967295")
+	var v = convert(raw, network.PgColumn{TypeOid: PgTypeOid}, uint32(len(raw)), nil, true)
+	if v != uint32(4294967295) {
+		t.Fatal(v)
+	}
+}
+
+func TestConvertBinaryFormat(t *testing.T) {
+	var raw = []byte{0, 0, 0, 42}
+	// 没有二进制解码函数的类型原样返回
+	var v = convert(raw, network.PgColumn{TypeOid: PgTypeNumeric, FormatCode: network.FormatBinary}, 4, nil, true)
+	b, ok := v.([]byte)
+	if !ok || len(b) != 4 || b[3] != 42 {
+		t.Fatal(v)
+	}
+	for _, c := range []struct {
+		oid  uint32
+		raw  []byte
+		want driver.Value
+	}{
+		{PgTypeInt4, raw, 42},
+		{PgTypeInt2, []byte{0xff, 0xfe}, -2},
+		{PgTypeInt8, []byte{0, 0, 0, 1, 0, 0, 0, 0}, 1 << 32},
+		{PgTypeBool, []byte{1}, true},
+	} {
+		if v = convert(c.raw, network.PgColumn{TypeOid: c.oid, FormatCode: network.FormatBinary}, uint32(len(c.raw)), nil, true); v != c.want {
+			t.Fatal(c.oid, v)
+		}
+	}
+}
+
+func TestResultFormats(t *testing.T) {
+	var cols = []network.PgColumn{{TypeOid: PgTypeText}, {TypeOid: PgTypeInt8}}
+	if f := resultFormats(cols); len(f) != 2 || f[0] != network.FormatText || f[1] != network.FormatBinary {
+		t.Fatal(f)
+	}
+	if cols[1].FormatCode != network.FormatBinary {
+		t.Fatal(cols)
+	}
+	if f := resultFormats([]network.PgColumn{{TypeOid: PgTypeText}}); f != nil {
+		t.Fatal(f)
+	}
+}
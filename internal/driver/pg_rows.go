@@ -7,18 +7,16 @@
 package driver
 
 import (
-	"database/sql"
 	"database/sql/driver"
 	"fmt"
 	"github.com/blusewang/pg/internal/network"
 	"io"
 	"math"
 	"reflect"
+	"sync"
 	"time"
 )
 
-const headerSize = 4
-
 type PgRows struct {
 	isStrict       bool
 	location       *time.Location
@@ -27,6 +25,18 @@ type PgRows struct {
 	fieldLen       *[][]uint32
 	rows           *[][][]byte
 	position       int
+	// 多语句简单查询时，尚未读取的结果集
+	sets []network.ResultSet
+	// 连接上由 DiscoverTypes 读取的类型，可能为 nil
+	types *typeCache
+	// 设置了 max_result_rows 时结果在未命名门户中分批获取：门户挂起时，Next 读完当前一批后
+	// 持有连接的 mu 获取下一批，Close 需要在服务端关闭该门户。
+	// 其间连接上开始其它请求时由 drain 读完剩余的行，suspended 等字段因此都由 mu 保护
+	io        *network.PgIO
+	mu        *sync.Mutex
+	suspended bool
+	// drain 读取剩余的行时出错，读完已缓存的行后由 Next 返回
+	err error
 }
 
 func (pr *PgRows) Columns() (cols []string) {
@@ -36,23 +46,49 @@ func (pr *PgRows) Columns() (cols []string) {
 	return
 }
 
-func (pr *PgRows) Close() error {
+// Close 对已全部缓存的结果只释放内存；门户挂起时同时在服务端关闭门户
+func (pr *PgRows) Close() (err error) {
+	if pr.mu != nil {
+		pr.mu.Lock()
+		defer pr.mu.Unlock()
+	}
+	if pr.suspended {
+		pr.suspended = false
+		if pr.io.IOError != nil {
+			err = driver.ErrBadConn
+		} else {
+			err = pr.io.ClosePortal("")
+		}
+	}
 	pr.position = 0
 	pr.rows = nil
 	pr.fieldLen = nil
 	pr.columns = nil
 	pr.parameterTypes = nil
-	return nil
+	pr.sets = nil
+	return
 }
 
 func (pr *PgRows) Next(dest []driver.Value) error {
+	if pr.mu != nil {
+		pr.mu.Lock()
+		defer pr.mu.Unlock()
+	}
+	if pr.rows == nil {
+		return io.EOF
+	}
+	for pr.suspended && pr.position == len(*pr.rows) {
+		if err := pr.fetch(); err != nil {
+			return err
+		}
+	}
 	var rowsLen = len(*pr.rows)
-	if rowsLen == 0 {
-		return sql.ErrNoRows
-	} else if pr.position < 0 || pr.position >= rowsLen {
-		return fmt.Errorf("pg_rows rows length is %v but position is %v", rowsLen, pr.position)
+	if pr.position == rowsLen && pr.err != nil {
+		return pr.err
 	} else if pr.position == rowsLen {
 		return io.EOF
+	} else if pr.position < 0 || pr.position > rowsLen {
+		return fmt.Errorf("pg_rows rows length is %v but position is %v", rowsLen, pr.position)
 	}
 	for k, v := range (*pr.rows)[pr.position] {
 		dest[k] = convert(v, pr.columns[k], (*pr.fieldLen)[pr.position][k], pr.location, pr.isStrict)
@@ -61,19 +97,51 @@ func (pr *PgRows) Next(dest []driver.Value) error {
 	return nil
 }
 
+// fetch 当前一批已读完且门户挂起时，取回下一批。调用方持有 mu
+func (pr *PgRows) fetch() (err error) {
+	if pr.io.IOError != nil {
+		pr.suspended = false
+		return driver.ErrBadConn
+	}
+	fieldLen, rows, suspended, err := pr.io.FetchPortal("", pr.io.MaxResultRows)
+	pr.suspended = suspended
+	if err != nil {
+		return err
+	}
+	pr.fieldLen, pr.rows, pr.position = fieldLen, rows, 0
+	return nil
+}
+
+// drain 连接上开始其它请求前读完门户中剩余的行，接在尚未读取的行之后。调用方持有 mu
+func (pr *PgRows) drain() (err error) {
+	if !pr.suspended {
+		return nil
+	}
+	fieldLen, rows, _, err := pr.io.FetchPortal("", 0)
+	pr.suspended = false
+	if err != nil {
+		pr.err = err
+		// 服务端的错误只影响本结果，连接仍可执行新请求
+		if _, ok := err.(*network.PgError); ok {
+			return nil
+		}
+		return err
+	}
+	*pr.fieldLen = append((*pr.fieldLen)[pr.position:], *fieldLen...)
+	*pr.rows = append((*pr.rows)[pr.position:], *rows...)
+	pr.position = 0
+	return nil
+}
+
 // may be implemented by Rows. It should return the precision and scale for decimal types.
 // If not applicable, ok should be false.
 func (pr *PgRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
-	var fd = pr.columns[index]
-	switch fd.TypeOid {
-	case PgTypeNumeric, PgTypeArrNumeric:
-		mod := fd.TypeModifier - headerSize
-		precision = int64((mod >> 16) & 0xffff)
-		scale = int64(mod & 0xffff)
-		return precision, scale, true
-	default:
+	p, ok := pr.columns[index].NumericPrecision()
+	if !ok {
 		return 0, 0, false
 	}
+	s, _ := pr.columns[index].NumericScale()
+	return int64(p), int64(s), true
 }
 
 func (pr *PgRows) ColumnTypeLength(index int) (length int64, ok bool) {
@@ -81,27 +149,55 @@ func (pr *PgRows) ColumnTypeLength(index int) (length int64, ok bool) {
 	case PgTypeText, PgTypeBytea:
 		return math.MaxInt64, true
 	case PgTypeVarchar, PgTypeBpchar:
-		return int64(pr.columns[index].TypeModifier - headerSize), true
+		// 未声明长度时不限长
+		if n, ok := pr.columns[index].CharMaxLength(); ok {
+			return int64(n), true
+		}
+		return math.MaxInt64, true
 	default:
 		return 0, false
 	}
 }
 
+// ColumnTypeDatabaseTypeName 返回列的数据库类型名，如 INT4、TEXT、_INT4。
+// 扩展类型及自定义类型需先调用 PgConn.DiscoverTypes，否则返回空字符串
 func (pr *PgRows) ColumnTypeDatabaseTypeName(index int) string {
-	return PgTypeMap[PgType(pr.columns[index].TypeOid)]
+	return pr.types.typeName(pr.columns[index].TypeOid)
+}
+
+// ColumnTypeNullable RowDescription 不携带列的可空信息，总是返回 ok=false
+func (pr *PgRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	return false, false
 }
 
+// ColumnTypeScanType 返回适合接收该列的 Go 类型，未知类型返回 []byte
 func (pr *PgRows) ColumnTypeScanType(index int) reflect.Type {
+	if pr.columns[index].FormatCode == network.FormatBinary && binaryDecoders[PgType(pr.columns[index].TypeOid)] == nil {
+		return reflect.TypeOf([]byte(nil))
+	}
 	switch PgType(pr.columns[index].TypeOid) {
 	case PgTypeBool:
 		return reflect.TypeOf(false)
 	case PgTypeDate, PgTypeTime, PgTypeTimestamp, PgTypeTimestamptz, PgTypeTimetz:
 		return reflect.TypeOf(time.Time{})
-	case PgTypeInt2, PgTypeInt4, PgTypeInt8:
+	case PgTypeInt2:
+		return reflect.TypeOf(int16(0))
+	case PgTypeInt4:
+		return reflect.TypeOf(int32(0))
+	case PgTypeInt8:
 		return reflect.TypeOf(int64(0))
-	case PgTypeFloat4, PgTypeFloat8, PgTypeNumeric:
+	case PgTypeFloat4:
+		return reflect.TypeOf(float32(0))
+	case PgTypeFloat8, PgTypeNumeric:
 		return reflect.TypeOf(float64(0))
-	case PgTypeText, PgTypeVarchar, PgTypeChar, PgTypeUuid, PgTypeJson, PgTypeJsonb, PgTypePoint:
+	case PgTypeOid:
+		return reflect.TypeOf(uint32(0))
+	case PgTypeTid:
+		return reflect.TypeOf(TID{})
+	case PgTypeBytea:
+		return reflect.TypeOf([]byte(nil))
+	case PgTypeText, PgTypeVarchar, PgTypeChar, PgTypeBpchar, PgTypeName, PgTypeUuid, PgTypeJson, PgTypeJsonb,
+		PgTypeXml, PgTypePoint, PgTypeInterval, PgTypeInet, PgTypeCidr, PgTypeMacaddr, PgTypeMoney:
 		return reflect.TypeOf("")
 
 	case PgTypeArrBool:
@@ -116,7 +212,7 @@ func (pr *PgRows) ColumnTypeScanType(index int) reflect.Type {
 		return reflect.TypeOf([]string{})
 
 	default:
-		return reflect.TypeOf("")
+		return reflect.TypeOf([]byte(nil))
 	}
 }
 
@@ -124,7 +220,7 @@ func (pr *PgRows) ColumnTypeScanType(index int) reflect.Type {
 // HasNextResultSet is called at the end of the current result set and
 // reports whether there is another result set after the current one.
 func (pr *PgRows) HasNextResultSet() bool {
-	return false
+	return len(pr.sets) > 0
 }
 
 // NextResultSet advances the driver to the next result set even
@@ -132,5 +228,17 @@ func (pr *PgRows) HasNextResultSet() bool {
 //
 // NextResultSet should return io.EOF when there are no more result sets.
 func (pr *PgRows) NextResultSet() error {
+	if len(pr.sets) == 0 {
+		return io.EOF
+	}
+	pr.setResult(pr.sets[0])
+	pr.sets = pr.sets[1:]
 	return nil
 }
+
+func (pr *PgRows) setResult(rs network.ResultSet) {
+	pr.columns = rs.Columns
+	pr.fieldLen = rs.FieldLen
+	pr.rows = rs.Rows
+	pr.position = 0
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"database/sql/driver"
+	"github.com/blusewang/pg/internal/network"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testResultSet(name string, values ...string) network.ResultSet {
+	var rs = network.ResultSet{
+		Columns:  []network.PgColumn{{Name: name, TypeOid: PgTypeText}},
+		FieldLen: new([][]uint32),
+		Rows:     new([][][]byte),
+	}
+	for _, v := range values {
+		*rs.FieldLen = append(*rs.FieldLen, []uint32{uint32(len(v))})
+		*rs.Rows = append(*rs.Rows, [][]byte{[]byte(v)})
+	}
+	return rs
+}
+
+func TestPgRowsNextResultSet(t *testing.T) {
+	var pr = new(PgRows)
+	pr.setResult(testResultSet("a", "1", "2"))
+	pr.sets = []network.ResultSet{testResultSet("b", "3")}
+
+	var dest = make([]driver.Value, 1)
+	for _, want := range []string{"1", "2"} {
+		if err := pr.Next(dest); err != nil || dest[0] != want {
+			t.Fatal(dest[0], err)
+		}
+	}
+	if err := pr.Next(dest); err != io.EOF {
+		t.Fatal(err)
+	}
+	if !pr.HasNextResultSet() {
+		t.Fatal("expect another result set")
+	}
+	if err := pr.NextResultSet(); err != nil {
+		t.Fatal(err)
+	}
+	if pr.Columns()[0] != "b" {
+		t.Fatal(pr.Columns())
+	}
+	if err := pr.Next(dest); err != nil || dest[0] != "3" {
+		t.Fatal(dest[0], err)
+	}
+	if pr.HasNextResultSet() || pr.NextResultSet() != io.EOF {
+		t.Fatal("expect no more result sets")
+	}
+}
+
+func TestPgRowsColumnTypes(t *testing.T) {
+	var pr = new(PgRows)
+	pr.columns = []network.PgColumn{
+		{Name: "a", TypeOid: PgTypeInt4},
+		{Name: "b", TypeOid: PgTypeTimestamptz},
+		{Name: "c", TypeOid: PgTypeNumeric, TypeModifier: 10<<16 | 2 + 4},
+		{Name: "d", TypeOid: PgTypeNumeric, TypeModifier: -1},
+		{Name: "e", TypeOid: PgTypeVarchar, TypeModifier: 20 + 4},
+		{Name: "f", TypeOid: PgTypeVarchar, TypeModifier: -1},
+		{Name: "g", TypeOid: PgTypeArrInt4},
+	}
+	for i, want := range []string{"INT4", "TIMESTAMP WITH TIME ZONE", "NUMERIC", "NUMERIC", "VARCHAR", "VARCHAR", "_INT4"} {
+		if name := pr.ColumnTypeDatabaseTypeName(i); name != want {
+			t.Fatal(i, name)
+		}
+	}
+	if p, s, ok := pr.ColumnTypePrecisionScale(2); !ok || p != 10 || s != 2 {
+		t.Fatal(p, s, ok)
+	}
+	if _, _, ok := pr.ColumnTypePrecisionScale(3); ok {
+		t.Fatal("unconstrained numeric has no precision")
+	}
+	if l, ok := pr.ColumnTypeLength(4); !ok || l != 20 {
+		t.Fatal(l, ok)
+	}
+	if l, ok := pr.ColumnTypeLength(5); !ok || l != math.MaxInt64 {
+		t.Fatal(l, ok)
+	}
+	if _, ok := pr.ColumnTypeNullable(0); ok {
+		t.Fatal("nullable is unknown")
+	}
+}
+
+func TestPgRowsColumnTypeScanType(t *testing.T) {
+	var pr = new(PgRows)
+	var cases = []struct {
+		col  network.PgColumn
+		kind reflect.Type
+	}{
+		{network.PgColumn{TypeOid: PgTypeInt4}, reflect.TypeOf(int32(0))},
+		{network.PgColumn{TypeOid: PgTypeInt8}, reflect.TypeOf(int64(0))},
+		{network.PgColumn{TypeOid: PgTypeTimestamptz}, reflect.TypeOf(time.Time{})},
+		{network.PgColumn{TypeOid: PgTypeText}, reflect.TypeOf("")},
+		{network.PgColumn{TypeOid: PgTypeBool}, reflect.TypeOf(false)},
+		{network.PgColumn{TypeOid: PgTypeArrInt4}, reflect.TypeOf([]int64{})},
+		{network.PgColumn{TypeOid: PgTypeTsvector}, reflect.TypeOf([]byte(nil))},
+		{network.PgColumn{TypeOid: PgTypeNumeric, FormatCode: network.FormatBinary}, reflect.TypeOf([]byte(nil))},
+		{network.PgColumn{TypeOid: PgTypeInt4, FormatCode: network.FormatBinary}, reflect.TypeOf(int32(0))},
+	}
+	for i, c := range cases {
+		pr.columns = []network.PgColumn{c.col}
+		if v := pr.ColumnTypeScanType(0); v != c.kind {
+			t.Fatal(i, v)
+		}
+	}
+}
+
+func TestPgRowsClose(t *testing.T) {
+	// 结果已全部缓存时不访问连接
+	var pr = new(PgRows)
+	pr.setResult(testResultSet("a", "1"))
+	if err := pr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pr = new(PgRows)
+	pr.io = network.NewPgIO(nil)
+	pr.io.IOError = io.EOF
+	pr.mu = new(sync.Mutex)
+	pr.suspended = true
+	if err := pr.Close(); err != driver.ErrBadConn {
+		t.Fatal(err)
+	}
+	if err := pr.Close(); err != nil {
+		t.Fatal("a second Close must not close the portal again:", err)
+	}
+}
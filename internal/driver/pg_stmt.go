@@ -8,26 +8,39 @@ package driver
 
 import (
 	"context"
+	"crypto/md5"
 	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"github.com/blusewang/pg/internal/helper"
 	"github.com/blusewang/pg/internal/network"
+	"strings"
+	"sync"
 )
 
+// NewPgStmt 以 query 的 md5 命名预备语句并缓存在连接上，从不使用未命名语句，
+// 因此不会与扩展查询中的未命名语句相互覆盖。驱动内部使用的语句不关闭，留待复用。
+// 调用方须持有 conn.mu
 func NewPgStmt(conn *PgConn, query string) (st *PgStmt, err error) {
 	if conn.io.IOError != nil {
 		return nil, driver.ErrBadConn
 	}
-	var id = conn.io.Md5(query)
+	var sum = md5.Sum([]byte(query))
+	var id = hex.EncodeToString(sum[:])
 	st = conn.stmts[id]
 	if st == nil {
 		st = new(PgStmt)
 		st.pgConn = conn
 		st.Identifies = id
 		st.Sql = query
-		st.columns, st.parameterTypes, err = st.pgConn.io.Parse(st.Identifies, st.Sql)
-		st.resultSig = make(chan int)
+		// Parse 失败时服务端没有该语句，不能缓存，否则下次会拿到未预备的语句
+		if st.columns, st.parameterTypes, err = st.pgConn.io.Parse(st.Identifies, st.Sql); err != nil {
+			return nil, err
+		}
+		st.formats = resultFormats(st.columns)
 		conn.stmts[id] = st
 	}
-	return st, err
+	return st, nil
 }
 
 type PgStmt struct {
@@ -36,54 +49,84 @@ type PgStmt struct {
 	Sql            string
 	columns        []network.PgColumn
 	parameterTypes []uint32
-	resultSig      chan int
+	// 各结果列的传输格式，见 resultFormats
+	formats []uint16
+	// 经 PrepareSession 取得且尚未 Close 的次数，与 closeOnce 一样由 pgConn.mu 保护
+	refs      int
+	closeOnce sync.Once
 }
 
+// Close 可重复调用：服务端的语句只关闭一次，之后的调用直接返回 nil。
+// 关闭后同一 query 会重新 Parse 出新的 PgStmt，旧对象的重复 Close 不会影响新语句
 func (s *PgStmt) Close() (err error) {
+	s.pgConn.mu.Lock()
+	defer s.pgConn.mu.Unlock()
+	if s.refs > 1 {
+		s.refs--
+		return nil
+	}
+	s.refs = 0
 	if s.pgConn.io.IOError != nil {
 		return driver.ErrBadConn
 	}
-	err = s.pgConn.io.CloseParse(s.Identifies)
-	if err != nil {
-		return
-	}
-	close(s.resultSig)
-	if s.pgConn.stmts[s.Identifies] != nil {
-		delete(s.pgConn.stmts, s.Identifies)
-	}
-	return nil
+	s.closeOnce.Do(func() {
+		if !s.isEmpty() {
+			err = s.pgConn.io.CloseParse(s.Identifies)
+		}
+		if s.pgConn.stmts[s.Identifies] == s {
+			delete(s.pgConn.stmts, s.Identifies)
+		}
+	})
+	return
 }
 
 func (s *PgStmt) NumInput() int {
 	return len(s.parameterTypes)
 }
 
-func (s *PgStmt) Exec(args []driver.Value) (res driver.Result, err error) {
-	if s.pgConn.io.IOError != nil {
-		return nil, driver.ErrBadConn
-	}
-	var as []interface{}
-	for _, v := range args {
-		as = append(as, v)
-	}
-	n, err := s.pgConn.io.ParseExec(s.Identifies, as)
-	return driver.RowsAffected(n), err
+// NumOutput 返回结果列数，为 0 时语句不返回行（DML、DDL 等）
+func (s *PgStmt) NumOutput() int {
+	return len(s.columns)
 }
 
-func (s *PgStmt) Query(args []driver.Value) (_ driver.Rows, err error) {
-	var as []interface{}
-	for _, v := range args {
-		as = append(as, v)
+// Columns 返回服务端 Describe 得到的结果列信息，调用方不应修改
+func (s *PgStmt) Columns() []network.PgColumn {
+	return s.columns
+}
+
+// ParameterTypes 返回服务端为每个 $n 参数推断出的类型 OID，调用方不应修改。
+// OID 为 0 表示服务端未能推断类型，将在绑定时根据参数值推断
+func (s *PgStmt) ParameterTypes() []uint32 {
+	return s.parameterTypes
+}
+
+// ParameterTypeName 返回第 i 个参数（从 0 开始）的类型名，如 INT4、TEXT。
+// 扩展类型及自定义类型需先调用 PgConn.DiscoverTypes，否则返回空字符串
+func (s *PgStmt) ParameterTypeName(i int) (string, error) {
+	if i < 0 || i >= len(s.parameterTypes) {
+		return "", fmt.Errorf("pg: parameter index %d out of range, statement has %d parameters", i, len(s.parameterTypes))
 	}
+	return s.pgConn.types.typeName(s.parameterTypes[i]), nil
+}
 
-	var pr = new(PgRows)
-	pr.isStrict = s.pgConn.dsn.IsStrict
-	pr.location = s.pgConn.io.Location
-	pr.columns = s.columns
-	pr.parameterTypes = s.parameterTypes
-	pr.fieldLen, pr.rows, err = s.pgConn.io.ParseQuery(s.Identifies, as)
+func (s *PgStmt) Exec(args []driver.Value) (driver.Result, error) {
+	var as = make([]interface{}, len(args))
+	for i, v := range args {
+		as[i] = v
+	}
+	s.pgConn.mu.Lock()
+	defer s.pgConn.mu.Unlock()
+	return s.exec(as)
+}
 
-	return pr, err
+func (s *PgStmt) Query(args []driver.Value) (driver.Rows, error) {
+	var as = make([]interface{}, len(args))
+	for i, v := range args {
+		as[i] = v
+	}
+	s.pgConn.mu.Lock()
+	defer s.pgConn.mu.Unlock()
+	return s.query(context.Background(), as)
 }
 
 // ExecContext executes a query that doesn't return rows, such
@@ -91,57 +134,198 @@ func (s *PgStmt) Query(args []driver.Value) (_ driver.Rows, err error) {
 //
 // ExecContext must honor the context timeout and return when it is canceled.
 func (s *PgStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
-	go s.watchCancel(ctx)
-	defer s.complete()
-	if s.pgConn.io.IOError != nil {
-		return nil, driver.ErrBadConn
-	}
-	var as []interface{}
-	for _, v := range args {
-		as = append(as, v.Value)
-	}
-	n, err := s.pgConn.io.ParseExec(s.Identifies, as)
-	return driver.RowsAffected(n), err
+	s.pgConn.mu.Lock()
+	defer s.pgConn.mu.Unlock()
+	// 取得锁之后再监听 ctx：等锁时的取消不会波及正在执行的其他查询，返回时先于解锁撤销监听
+	defer s.pgConn.io.WatchCancel(ctx)()
+	return s.exec(namedValues(args))
 }
 
 // QueryContext executes a query that may return rows, such as a
 // SELECT.
 //
 // QueryContext must honor the context timeout and return when it is canceled.
-func (s *PgStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (_ driver.Rows, err error) {
-	go s.watchCancel(ctx)
-	defer s.complete()
+func (s *PgStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	s.pgConn.mu.Lock()
+	defer s.pgConn.mu.Unlock()
+	return s.query(ctx, namedValues(args))
+}
+
+func namedValues(args []driver.NamedValue) []interface{} {
+	var as = make([]interface{}, len(args))
+	for i, v := range args {
+		as[i] = v.Value
+	}
+	return as
+}
+
+// exec 及 query 由调用方持有 pgConn.mu
+func (s *PgStmt) exec(as []interface{}) (_ driver.Result, err error) {
 	if s.pgConn.io.IOError != nil {
 		return nil, driver.ErrBadConn
 	}
+	if err = s.validateArgs(len(as)); err != nil {
+		return nil, err
+	}
+	if err = s.coerce(as); err != nil {
+		return nil, err
+	}
+	if s.isEmpty() {
+		return driver.RowsAffected(0), nil
+	}
+	_, n, err := s.pgConn.io.ParseExec(s.Identifies, as)
+	return driver.RowsAffected(n), err
+}
 
-	var as []interface{}
-	for _, v := range args {
-		as = append(as, v.Value)
+func (s *PgStmt) query(ctx context.Context, as []interface{}) (_ driver.Rows, err error) {
+	if s.pgConn.io.IOError != nil {
+		return nil, driver.ErrBadConn
+	}
+	if err = s.validateArgs(len(as)); err != nil {
+		return nil, err
+	}
+	if err = s.coerce(as); err != nil {
+		return nil, err
 	}
 
 	var pr = new(PgRows)
 	pr.isStrict = s.pgConn.dsn.IsStrict
 	pr.location = s.pgConn.io.Location
+	pr.types = s.pgConn.types
 	pr.columns = s.columns
 	pr.parameterTypes = s.parameterTypes
-	pr.fieldLen, pr.rows, err = s.pgConn.io.ParseQuery(s.Identifies, as)
-
+	if s.isEmpty() {
+		return pr, nil
+	}
+	if n := s.pgConn.io.MaxResultRows; n > 0 {
+		pr.io, pr.mu = s.pgConn.io, &s.pgConn.mu
+		pr.fieldLen, pr.rows, pr.suspended, err = s.pgConn.io.ParseQueryFetchContext(ctx, "", s.Identifies, as, s.formats, n)
+	} else {
+		pr.fieldLen, pr.rows, err = s.pgConn.io.ParseQueryContextFormats(ctx, s.Identifies, as, s.formats)
+	}
+	if err != nil {
+		return nil, s.refreshColumns(err)
+	}
+	if pr.suspended {
+		// 读完之前在同一连接上执行其它语句时，先把剩余的行读入 pr
+		s.pgConn.io.SetPortalDrain(pr.drain)
+	}
 	return pr, nil
 }
 
-func (s *PgStmt) watchCancel(ctx context.Context) {
-	select {
-	case <-ctx.Done():
-		s.cancel()
-	case <-s.resultSig:
+// ExplainContext 以 EXPLAIN EXECUTE 返回该语句在给定参数下的执行计划，参数按 SQL 常量内联。
+// analyze 为 true 时语句会被真正执行
+func (s *PgStmt) ExplainContext(ctx context.Context, args []driver.NamedValue, analyze bool) (_ string, err error) {
+	s.pgConn.mu.Lock()
+	defer s.pgConn.mu.Unlock()
+	defer s.pgConn.io.WatchCancel(ctx)()
+	if s.pgConn.io.IOError != nil {
+		return "", driver.ErrBadConn
+	}
+	var as = namedValues(args)
+	if err = s.validateArgs(len(as)); err != nil {
+		return "", err
+	}
+	if err = s.coerce(as); err != nil {
+		return "", err
+	}
+	query, err := s.explainQuery(as, analyze)
+	if err != nil {
+		return "", err
 	}
+	_, _, data, err := s.pgConn.io.QueryNoArgs(query)
+	if err != nil {
+		return "", err
+	}
+	var lines = make([]string, len(*data))
+	for i, row := range *data {
+		lines[i] = string(row[0])
+	}
+	return strings.Join(lines, "\n"), nil
 }
 
-func (s *PgStmt) cancel() {
-	_ = s.pgConn.io.CancelRequest()
+func (s *PgStmt) explainQuery(args []interface{}, analyze bool) (string, error) {
+	name, err := helper.QuoteIdentifier(s.Identifies)
+	if err != nil {
+		return "", err
+	}
+	var query = "explain "
+	if analyze {
+		query += "analyze "
+	}
+	query += "execute " + name
+	if len(args) > 0 {
+		var literals = make([]string, len(args))
+		for i, arg := range args {
+			if arg == nil {
+				literals[i] = "null"
+			} else {
+				literals[i] = helper.QuoteLiteral(string(network.TextValue(arg)))
+			}
+		}
+		query += "(" + strings.Join(literals, ", ") + ")"
+	}
+	return query, nil
+}
+
+// refreshColumns 表结构变更后，服务端拒绝执行结果列已变的预备语句
+// （0A000 cached plan must not change result type）。不在事务中时重新预备该语句并更新缓存的列，
+// 列确实变化时返回包含 err 的 *ColumnLayoutChangedError；其余情况原样返回 err
+func (s *PgStmt) refreshColumns(err error) error {
+	if !isCachedPlanChanged(err) {
+		return err
+	}
+	// 事务已失败，无法在其中重新预备
+	if s.pgConn.io.IsInTransaction() || s.pgConn.io.CloseParse(s.Identifies) != nil {
+		return err
+	}
+	cols, parameterTypes, e := s.pgConn.io.Parse(s.Identifies, s.Sql)
+	if e != nil {
+		// 服务端已没有该语句，下次由 NewPgStmt 重新预备
+		if s.pgConn.stmts[s.Identifies] == s {
+			delete(s.pgConn.stmts, s.Identifies)
+		}
+		return err
+	}
+	var formats = resultFormats(cols)
+	var changed = network.RowDescriptionChanged(s.columns, cols)
+	s.columns, s.parameterTypes, s.formats = cols, parameterTypes, formats
+	if changed {
+		return &network.ColumnLayoutChangedError{Err: err.(*network.PgError)}
+	}
+	return err
 }
 
-func (s *PgStmt) complete() {
-	s.resultSig <- 1
+// isCachedPlanChanged 按 SQLSTATE 及报错的函数判断，不依赖随 lc_messages 翻译的消息文本。
+// 服务端（或中间的连接池）未返回函数名时只看 SQLSTATE，误判的代价只是多一次重新预备
+func isCachedPlanChanged(err error) bool {
+	e, ok := err.(*network.PgError)
+	return ok && e.SQLState == "0A000" && (e.Routine == "" || e.Routine == "RevalidateCachedQuery")
+}
+
+// 空语句不会在服务端预备（见 PgIO.Parse），执行时直接返回空结果
+func (s *PgStmt) isEmpty() bool {
+	return strings.TrimSpace(s.Sql) == ""
+}
+
+// validateArgs 在发送前检查参数个数，NumInput 为 -1 时不检查
+func (s *PgStmt) validateArgs(n int) error {
+	if want := s.NumInput(); want >= 0 && n != want {
+		return fmt.Errorf("pg: statement expects %d parameters, got %d", want, n)
+	}
+	return nil
+}
+
+// 参数类型与服务端推断的类型不一致时，在客户端完成转换
+func (s *PgStmt) coerce(args []interface{}) (err error) {
+	for i := range args {
+		if i >= len(s.parameterTypes) {
+			break
+		}
+		args[i], err = coerceArg(s.parameterTypes[i], args[i], s.pgConn.io.ServerMajorVersion())
+		if err != nil {
+			return
+		}
+	}
+	return
 }
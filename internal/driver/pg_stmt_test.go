@@ -0,0 +1,687 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"github.com/blusewang/pg/internal/helper"
+	"github.com/blusewang/pg/internal/network"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 需要真实的PG服务，通过环境变量 PG_DSN 指定数据源，未指定时跳过
+func testConn(t *testing.T) *PgConn {
+	var dsn = os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PG_DSN not set")
+	}
+	c, err := NewPgConn(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// 模拟服务端：每个预备语句有一个 text 参数，返回一列，每行依次为参数按逗号分隔的各部分。
+// Execute 遵守行数上限，超出时挂起门户。
+// 每个 Execute 先等待 delay 再回复。同一连接上的请求若交错，结果就会错位
+func testFakeConn(t *testing.T, delay time.Duration) *PgConn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		testFakeServe(conn, delay)
+	}()
+	dsn, err := helper.ParseDSN("pg://postgres@" + ln.Addr().String() + "/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c = &PgConn{dsn: dsn, io: network.NewPgIO(dsn), stmts: make(map[string]*PgStmt), types: new(typeCache)}
+	if err = c.io.DialDSN(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testFakeServe(conn net.Conn, delay time.Duration) {
+	var r = bufio.NewReader(conn)
+	var w = bufio.NewWriter(conn)
+	var reply = func(id byte, body ...[]byte) {
+		var n = 4
+		for _, b := range body {
+			n += len(b)
+		}
+		_ = w.WriteByte(id)
+		_ = binary.Write(w, binary.BigEndian, int32(n))
+		for _, b := range body {
+			_, _ = w.Write(b)
+		}
+	}
+	var int16b = func(n int) []byte { return []byte{byte(n >> 8), byte(n)} }
+	var int32b = func(n int) []byte { return []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)} }
+	// 门户中尚未返回的行
+	var rows [][]byte
+	// 出错后忽略其余消息，直到 Sync
+	var failed bool
+	// 参数为 stale 时，Execute 按表结构变更后的缓存计划报错
+	var stale bool
+	for {
+		id, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		var n int32
+		if binary.Read(r, binary.BigEndian, &n) != nil {
+			return
+		}
+		var body = make([]byte, n-4)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return
+		}
+		if failed && id != 'S' {
+			continue
+		}
+		switch id {
+		case 'P':
+			// 语句名之后是查询文本，含 syntax error 时按语法错误拒绝
+			if bytes.Contains(body, []byte("syntax error")) {
+				reply('E', []byte("SERROR\x00C42601\x00Msyntax error\x00\x00"))
+				failed = true
+				continue
+			}
+			reply('1')
+		case 'D':
+			reply('t', int16b(1), int32b(25))
+			reply('T', int16b(1), []byte("v\x00"), int32b(0), int16b(0), int32b(25), int16b(-1), int32b(-1), int16b(0))
+		case 'B':
+			// 门户名、语句名之后是参数格式个数（为 0）、参数个数及第一个参数
+			var p = bytes.IndexByte(body, 0) + 1
+			p += bytes.IndexByte(body[p:], 0) + 1
+			p += 4
+			var size = int(binary.BigEndian.Uint32(body[p:]))
+			rows = bytes.Split(body[p+4:p+4+size], []byte(","))
+			stale = string(body[p+4:p+4+size]) == "stale"
+			reply('2')
+		case 'E':
+			if stale {
+				reply('E', []byte("SERROR\x00C0A000\x00Mcached plan must not change result type\x00RRevalidateCachedQuery\x00\x00"))
+				failed = true
+				continue
+			}
+			time.Sleep(delay)
+			var limit = int(binary.BigEndian.Uint32(body[bytes.IndexByte(body, 0)+1:]))
+			var n = len(rows)
+			if limit > 0 && limit < n {
+				n = limit
+			}
+			for _, v := range rows[:n] {
+				reply('D', int16b(1), int32b(len(v)), v)
+			}
+			rows = rows[n:]
+			if limit > 0 && n == limit {
+				reply('s')
+			} else {
+				reply('C', []byte(fmt.Sprintf("SELECT %d\x00", n)))
+			}
+		case 'C':
+			rows = nil
+			reply('3')
+		case 'H':
+			if w.Flush() != nil {
+				return
+			}
+		case 'S':
+			failed = false
+			reply('Z', []byte{'I'})
+			if w.Flush() != nil {
+				return
+			}
+		case 'Q':
+			// 简单查询的每条语句都视为插入一行
+			for range bytes.Split(bytes.TrimSuffix(body, []byte{0}), []byte(";")) {
+				reply('C', []byte("INSERT 0 1\x00"))
+			}
+			reply('Z', []byte{'I'})
+			if w.Flush() != nil {
+				return
+			}
+		case 'X':
+			return
+		}
+	}
+}
+
+// 同一连接上的两个预备语句被多个 goroutine 同时使用，每次都应得到自己的结果
+func TestStmtSharedConn(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+
+	var stmts = make([]*PgStmt, 2)
+	for i := range stmts {
+		st, err := c.PrepareSession(fmt.Sprintf("select $1::text -- %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts[i] = st
+	}
+	var wg sync.WaitGroup
+	var errs = make(chan error, 100)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			var st = stmts[g%2]
+			for i := 0; i < 50; i++ {
+				var want = fmt.Sprintf("%d-%d", g, i)
+				rows, err := st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: want}})
+				if err != nil {
+					errs <- err
+					return
+				}
+				var dest = make([]driver.Value, 1)
+				if err = rows.Next(dest); err != nil {
+					errs <- err
+					return
+				}
+				if got := fmt.Sprint(dest[0]); got != want {
+					errs <- fmt.Errorf("got %q, want %q", got, want)
+					return
+				}
+				if _, err = st.ExecContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: want}}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// Close 在 ExecContext 执行期间被调用：等待执行结束后再关闭，两者都成功，语句从连接上移除
+func TestStmtCloseRace(t *testing.T) {
+	t.Parallel()
+	c := testFakeConn(t, 200*time.Millisecond)
+	defer c.Close()
+
+	st, err := c.PrepareSession("select $1::text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var execErr = make(chan error, 1)
+	go func() {
+		_, err := st.ExecContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "x"}})
+		execErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	var closeErr = make(chan error, 1)
+	go func() {
+		closeErr <- st.Close()
+	}()
+
+	var timeout = time.After(5 * time.Second)
+	select {
+	case err := <-execErr:
+		if err != nil {
+			t.Fatal("exec:", err)
+		}
+	case err := <-closeErr:
+		t.Fatal("close returned before exec finished:", err)
+	case <-timeout:
+		t.Fatal("deadlock between ExecContext and Close")
+	}
+	select {
+	case err := <-closeErr:
+		if err != nil {
+			t.Fatal("close:", err)
+		}
+	case <-timeout:
+		t.Fatal("deadlock between ExecContext and Close")
+	}
+	if _, has := c.stmts[st.Identifies]; has {
+		t.Fatal("closed statement still cached")
+	}
+}
+
+func TestStmtConcurrentExec(t *testing.T) {
+	t.Parallel()
+	c := testConn(t)
+	defer c.Close()
+
+	st, err := NewPgStmt(c, "select $1::int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := st.ExecContext(ctx, []driver.NamedValue{{Ordinal: 1, Value: int64(i)}}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStmtValidateArgs(t *testing.T) {
+	// 参数个数不符时在发送前返回，不会触及连接
+	var s = &PgStmt{pgConn: &PgConn{io: network.NewPgIO(nil)}, parameterTypes: []uint32{23, 23, 23}}
+	_, err := s.Exec([]driver.Value{int64(1), int64(2)})
+	if err == nil || err.Error() != "pg: statement expects 3 parameters, got 2" {
+		t.Fatal(err)
+	}
+	_, err = s.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: int64(1)}})
+	if err == nil || err.Error() != "pg: statement expects 3 parameters, got 1" {
+		t.Fatal(err)
+	}
+}
+
+func TestStmtNumOutput(t *testing.T) {
+	var s = &PgStmt{columns: []network.PgColumn{{Name: "id", TypeOid: PgTypeInt4}, {Name: "name", TypeOid: PgTypeText}}}
+	if s.NumOutput() != 2 || s.Columns()[1].Name != "name" {
+		t.Fatal(s.Columns())
+	}
+	if s = new(PgStmt); s.NumOutput() != 0 {
+		t.Fatal(s.NumOutput())
+	}
+}
+
+func TestStmtParameterTypes(t *testing.T) {
+	var types = new(typeCache)
+	types.replace(map[uint32]string{16385: "HSTORE"})
+	var s = &PgStmt{pgConn: &PgConn{types: types}, parameterTypes: []uint32{23, 16385, 0}}
+	if v := s.ParameterTypes(); len(v) != 3 || v[1] != 16385 {
+		t.Fatal(v)
+	}
+	for i, want := range []string{"INT4", "HSTORE", ""} {
+		if name, err := s.ParameterTypeName(i); err != nil || name != want {
+			t.Fatal(i, name, err)
+		}
+	}
+	if _, err := s.ParameterTypeName(3); err == nil {
+		t.Fatal("index out of range")
+	}
+}
+
+func TestStmtEmpty(t *testing.T) {
+	// 连接未建立：空语句不应触及网络
+	dsn, err := helper.ParseDSN("pg://postgres@localhost/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s = &PgStmt{pgConn: &PgConn{dsn: dsn, io: network.NewPgIO(dsn)}, Sql: " "}
+	if res, err := s.Exec(nil); err != nil {
+		t.Fatal(err)
+	} else if n, _ := res.RowsAffected(); n != 0 {
+		t.Fatal(n)
+	}
+	rows, err := s.QueryContext(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rows.Next(make([]driver.Value, 0)); err != io.EOF {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsCachedPlanChanged(t *testing.T) {
+	var cases = []struct {
+		err  error
+		want bool
+	}{
+		{&network.PgError{SQLState: "0A000", Message: "cached plan must not change result type", Routine: "RevalidateCachedQuery"}, true},
+		// 翻译后的消息文本
+		{&network.PgError{SQLState: "0A000", Message: "缓存的计划不能改变结果类型", Routine: "RevalidateCachedQuery"}, true},
+		{&network.PgError{SQLState: "0A000"}, true},
+		{&network.PgError{SQLState: "0A000", Routine: "transformLockingClause"}, false},
+		{&network.PgError{SQLState: "42P01", Routine: "RevalidateCachedQuery"}, false},
+		{io.EOF, false},
+	}
+	for i, c := range cases {
+		if isCachedPlanChanged(c.err) != c.want {
+			t.Fatal(i, c.err)
+		}
+	}
+}
+
+func TestStmtExplainQuery(t *testing.T) {
+	var s = &PgStmt{Identifies: "abc"}
+	q, err := s.explainQuery([]interface{}{int64(1), `it's \x`, nil}, true)
+	if err != nil || q != `explain analyze execute "abc"('1', E'it''s \\x', null)` {
+		t.Fatal(q, err)
+	}
+	if q, err = s.explainQuery(nil, false); err != nil || q != `explain execute "abc"` {
+		t.Fatal(q, err)
+	}
+}
+
+func TestStmtExplainContext(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	st, err := NewPgStmt(c, "select relname from pg_class where oid = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := st.ExplainContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: int64(1259)}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan, "pg_class") {
+		t.Fatal(plan)
+	}
+}
+
+func TestPrepareSessionShared(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	a, err := c.PrepareSession("select $1::int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.PrepareSession("select $1::int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("the same query must share one statement")
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// b 仍持有该语句
+	if _, err = b.Query([]driver.Value{int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.stmts[b.Identifies] != nil {
+		t.Fatal("the last Close must release the statement")
+	}
+}
+
+func TestStmtDoubleClose(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	old, err := c.PrepareSession("select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := c.PrepareSession("select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st == old {
+		t.Fatal("a closed statement must not be reused")
+	}
+	// 重复关闭旧语句不能影响同名的新语句
+	if err = old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.Query(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 结果列变化时返回的错误保留服务端原始的 0A000 错误
+func TestStmtColumnLayoutChangedError(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+
+	st, err := c.PrepareSession("select $1::text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟预备之后表上增加了一列
+	st.columns = append(st.columns, network.PgColumn{Name: "name", TypeOid: 25})
+	_, err = st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "stale"}})
+	e, ok := err.(*network.ColumnLayoutChangedError)
+	if !ok || e.Err.SQLState != "0A000" || e.Err.Routine != "RevalidateCachedQuery" {
+		t.Fatal(err)
+	}
+	if !e.Is(network.ErrColumnLayoutChanged) || e.Unwrap() != error(e.Err) {
+		t.Fatal(e)
+	}
+	if !strings.Contains(e.Error(), "cached plan must not change result type") {
+		t.Fatal(e.Error())
+	}
+	if st.NumOutput() != 1 {
+		t.Fatal(st.Columns())
+	}
+}
+
+func TestStmtColumnLayoutChanged(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	if _, _, _, err := c.io.QueryNoArgs("create temp table layout_changed (id int4)"); err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewPgStmt(c, "select * from layout_changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = c.io.QueryNoArgs("alter table layout_changed add column name text"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.Query(nil)
+	if e, ok := err.(*network.ColumnLayoutChangedError); !ok || e.Err.SQLState != "0A000" {
+		t.Fatal(err)
+	}
+	if st.NumOutput() != 2 {
+		t.Fatal(st.Columns())
+	}
+	if _, err = st.Query(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 预备失败的语句不缓存，再次预备同一查询仍返回错误，而不是未预备的语句
+func TestPrepareErrorNotCached(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		st, err := c.PrepareSession("select syntax error")
+		if e, ok := err.(*network.PgError); !ok || e.SQLState != "42601" || st != nil {
+			t.Fatal(i, st, err)
+		}
+	}
+	if len(c.stmts) != 0 {
+		t.Fatal(c.stmts)
+	}
+	if _, err := c.PrepareSession("select $1::text"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 数值类型的字符串参数在客户端转换后发送，无效的值在发送前即被拒绝
+func TestStmtCoerceArgs(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+
+	st, err := c.PrepareSession("select $1::int4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 假服务端总是推断为 text，这里改为 int4
+	st.parameterTypes[0] = PgTypeInt4
+	var dest = make([]driver.Value, 1)
+	rows, err := st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: " 0x2A "}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 假服务端原样返回收到的参数
+	if err = rows.Next(dest); err != nil || dest[0] != "42" {
+		t.Fatal(dest[0], err)
+	}
+	if err = rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "abc"}}); err == nil || !strings.Contains(err.Error(), "INT4") {
+		t.Fatal(err)
+	}
+	// 被拒绝的参数没有发送，连接仍可继续使用
+	if c.io.IOError != nil {
+		t.Fatal(c.io.IOError)
+	}
+	rows, err = st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rows.Next(dest); err != nil || dest[0] != "7" {
+		t.Fatal(dest[0], err)
+	}
+	if err = rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 读完之前在同一连接上执行其它语句，剩余的行先被读入，两边的结果都完整
+func TestStmtMaxResultRowsInterleaved(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+	c.io.MaxResultRows = 2
+
+	st, err := c.PrepareSession("select unnest(string_to_array($1, ','))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "a,b,c,d,e"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dest = make([]driver.Value, 1)
+	if err = rows.Next(dest); err != nil || dest[0] != "a" {
+		t.Fatal(dest[0], err)
+	}
+	inner, err := st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "x,y,z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 内层结果同样分批，外层剩余的行已读入，不再挂起
+	if err = inner.Next(dest); err != nil || dest[0] != "x" {
+		t.Fatal(dest[0], err)
+	}
+	if _, err = c.ExecContext(context.Background(), "insert into t values (1)", nil); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range []driver.Rows{inner, rows} {
+		for {
+			if err = r.Next(dest); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprint(dest[0]))
+		}
+		if err = r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(got, ",") != "y,z,b,c,d,e" {
+		t.Fatal(got)
+	}
+	if c.io.IOError != nil {
+		t.Fatal(c.io.IOError)
+	}
+}
+
+func TestStmtMaxResultRows(t *testing.T) {
+	c := testFakeConn(t, 0)
+	defer c.Close()
+	c.io.MaxResultRows = 2
+
+	st, err := c.PrepareSession("select unnest(string_to_array($1, ','))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "a,b,c,d,e"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var dest = make([]driver.Value, 1)
+	for {
+		if err = rows.Next(dest); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprint(dest[0]))
+	}
+	if strings.Join(got, ",") != "a,b,c,d,e" {
+		t.Fatal(got)
+	}
+	if err = rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 提前关闭时在服务端关闭门户，连接仍可继续使用
+	rows, err = st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "a,b,c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rows.Next(dest); err != nil || dest[0] != "a" {
+		t.Fatal(dest[0], err)
+	}
+	if err = rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = st.QueryContext(context.Background(), []driver.NamedValue{{Ordinal: 1, Value: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rows.Next(dest); err != nil || dest[0] != "x" {
+		t.Fatal(dest[0], err)
+	}
+	if err = rows.Next(dest); err != io.EOF {
+		t.Fatal(err)
+	}
+	_ = rows.Close()
+}
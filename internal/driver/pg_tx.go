@@ -16,6 +16,8 @@ type PgTx struct {
 }
 
 func (t *PgTx) Commit() (err error) {
+	t.pgConn.mu.Lock()
+	defer t.pgConn.mu.Unlock()
 	if t.pgConn.io.IOError != nil {
 		return driver.ErrBadConn
 	}
@@ -33,6 +35,8 @@ func (t *PgTx) Commit() (err error) {
 }
 
 func (t *PgTx) Rollback() (err error) {
+	t.pgConn.mu.Lock()
+	defer t.pgConn.mu.Unlock()
 	if t.pgConn.io.IOError != nil {
 		return driver.ErrBadConn
 	}
@@ -0,0 +1,116 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/blusewang/pg/internal/network"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const typesQuery = "select oid, upper(typname) from pg_type"
+
+// typeCache 从 pg_type 读取的 oid 到类型名的映射，补充 pgTypeNames 中没有的扩展类型及自定义类型
+type typeCache struct {
+	mu    sync.RWMutex
+	names map[uint32]string
+	// 定时刷新的 goroutine 运行时不为 nil，关闭后停止。由 PgConn.mu 保护
+	stop chan struct{}
+}
+
+func (tc *typeCache) name(oid uint32) string {
+	if tc == nil {
+		return ""
+	}
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.names[oid]
+}
+
+// typeName 先查内置类型，再查 DiscoverTypes 读到的类型，都没有时返回空字符串
+func (tc *typeCache) typeName(oid uint32) string {
+	if name, ok := pgTypeNames[PgType(oid)]; ok {
+		return name
+	}
+	return tc.name(oid)
+}
+
+func (tc *typeCache) replace(names map[uint32]string) {
+	tc.mu.Lock()
+	tc.names = names
+	tc.mu.Unlock()
+}
+
+// DiscoverTypes 读取 pg_type 中的全部类型。数据源设置了 type_refresh_interval 时，
+// 之后按该间隔在后台刷新，直到连接关闭
+func (c *PgConn) DiscoverTypes(ctx context.Context) (err error) {
+	if err = c.RefreshTypes(ctx); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dsn.TypeRefreshInterval > 0 && c.types.stop == nil && c.io.IOError == nil {
+		c.types.stop = make(chan struct{})
+		go c.refreshTypesLoop(c.dsn.TypeRefreshInterval, c.types.stop)
+	}
+	return
+}
+
+// RefreshTypes 重新读取 pg_type 并整体替换类型映射，用于会话中途 CREATE TYPE 或加载扩展之后
+func (c *PgConn) RefreshTypes(ctx context.Context) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.io.IOError != nil {
+		return driver.ErrBadConn
+	}
+	defer c.io.WatchCancel(ctx)()
+	names, err := queryTypes(c.io)
+	if err != nil {
+		return
+	}
+	c.types.replace(names)
+	return
+}
+
+// 后台刷新在本连接上执行，与其它请求一样先取得 PgConn.mu，不会与正在执行的查询交错。
+// 门户挂起等暂时无法查询的情况留到下一次，连接失效后停止
+func (c *PgConn) refreshTypesLoop(interval time.Duration, stop chan struct{}) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := c.RefreshTypes(ctx)
+		cancel()
+		if err == driver.ErrBadConn {
+			return
+		}
+	}
+}
+
+func queryTypes(pi *network.PgIO) (names map[uint32]string, err error) {
+	_, _, data, err := pi.QueryNoArgs(typesQuery)
+	if err != nil {
+		return
+	}
+	names = make(map[uint32]string, len(*data))
+	for _, row := range *data {
+		oid, err := strconv.ParseUint(string(row[0]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		names[uint32(oid)] = string(row[1])
+	}
+	return
+}
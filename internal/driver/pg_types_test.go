@@ -0,0 +1,96 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package driver
+
+import (
+	"context"
+	"github.com/blusewang/pg/internal/network"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestColumnTypeDatabaseTypeNameDiscovered(t *testing.T) {
+	var pr = new(PgRows)
+	pr.columns = []network.PgColumn{{Name: "a", TypeOid: 23}, {Name: "b", TypeOid: 16385}}
+	if n := pr.ColumnTypeDatabaseTypeName(1); n != "" {
+		t.Fatal(n)
+	}
+	pr.types = new(typeCache)
+	pr.types.replace(map[uint32]string{16385: "MOOD"})
+	if n := pr.ColumnTypeDatabaseTypeName(0); n != "INT4" {
+		t.Fatal(n)
+	}
+	if n := pr.ColumnTypeDatabaseTypeName(1); n != "MOOD" {
+		t.Fatal(n)
+	}
+}
+
+func TestRefreshTypes(t *testing.T) {
+	c := testConn(t)
+	defer c.Close()
+
+	if err := c.DiscoverTypes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.types.name(uint32(PgTypeInt4)); n != "INT4" {
+		t.Fatal(n)
+	}
+	if _, _, err := c.io.QueryNoArgsExec("create type pg_temp.mood as enum ('sad', 'happy')"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, data, err := c.io.QueryNoArgs("select 'pg_temp.mood'::regtype::oid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.RefreshTypes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	oid, err := strconv.ParseUint(string((*data)[0][0]), 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c.types.name(uint32(oid)); n != "MOOD" {
+		t.Fatal(n)
+	}
+}
+
+// 后台刷新在本连接上执行：假服务端只接受一个连接，另建连接无法刷新
+func TestRefreshTypesLoop(t *testing.T) {
+	c := testFakeConn(t, 0)
+	c.dsn.TypeRefreshInterval = 10 * time.Millisecond
+	if err := c.DiscoverTypes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.types.replace(map[uint32]string{16385: "MOOD"})
+	var deadline = time.Now().Add(5 * time.Second)
+	for c.types.name(16385) != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("types were not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 与 Close 并发时只会停止一次
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = c.DiscoverTypes(context.Background())
+	}()
+	go func() {
+		defer wg.Done()
+		_ = c.Close()
+	}()
+	wg.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.types.stop != nil {
+		t.Fatal("refresh loop still running after Close")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package helper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 标签中带有行数的命令，INSERT 另带 oid
+var rowCountCommands = map[string]bool{
+	"INSERT": true,
+	"DELETE": true,
+	"UPDATE": true,
+	"MERGE":  true,
+	"SELECT": true,
+	"MOVE":   true,
+	"FETCH":  true,
+	"COPY":   true,
+}
+
+// ParseCommandComplete 解析 CommandComplete 的标签。
+//
+//	INSERT oid rows
+//	DELETE|UPDATE|MERGE|SELECT|MOVE|FETCH|COPY rows
+//	其余命令（CREATE TABLE、VACUUM 等）只有命令名，rowsAffected 为 0
+func ParseCommandComplete(tag string) (command string, oid uint32, rowsAffected int64, err error) {
+	var fields = strings.Fields(tag)
+	if len(fields) == 0 {
+		return "", 0, 0, fmt.Errorf("pg: empty command tag")
+	}
+	if !rowCountCommands[fields[0]] {
+		return tag, 0, 0, nil
+	}
+	command = fields[0]
+	switch {
+	case command == "INSERT" && len(fields) == 3:
+		n, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return command, 0, 0, fmt.Errorf("pg: invalid oid in command tag %q", tag)
+		}
+		oid = uint32(n)
+	case command != "INSERT" && len(fields) == 2:
+	default:
+		return command, 0, 0, fmt.Errorf("pg: invalid command tag %q", tag)
+	}
+	rowsAffected, err = strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return command, 0, 0, fmt.Errorf("pg: invalid row count in command tag %q", tag)
+	}
+	return
+}
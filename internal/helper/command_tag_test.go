@@ -0,0 +1,46 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package helper
+
+import "testing"
+
+func TestParseCommandComplete(t *testing.T) {
+	var cases = []struct {
+		tag     string
+		command string
+		oid     uint32
+		rows    int64
+	}{
+		{"INSERT 0 5", "INSERT", 0, 5},
+		{"INSERT 16385 1", "INSERT", 16385, 1},
+		{"DELETE 3", "DELETE", 0, 3},
+		{"UPDATE 10", "UPDATE", 0, 10},
+		{"MERGE 7", "MERGE", 0, 7},
+		{"SELECT 5", "SELECT", 0, 5},
+		{"MOVE 2", "MOVE", 0, 2},
+		{"FETCH 100", "FETCH", 0, 100},
+		{"COPY 100", "COPY", 0, 100},
+		{"CREATE TABLE", "CREATE TABLE", 0, 0},
+		{"DROP INDEX", "DROP INDEX", 0, 0},
+		{"VACUUM", "VACUUM", 0, 0},
+		{"BEGIN", "BEGIN", 0, 0},
+	}
+	for _, c := range cases {
+		command, oid, rows, err := ParseCommandComplete(c.tag)
+		if err != nil {
+			t.Fatal(c.tag, err)
+		}
+		if command != c.command || oid != c.oid || rows != c.rows {
+			t.Fatal(c.tag, command, oid, rows)
+		}
+	}
+	for _, tag := range []string{"", "INSERT 5", "UPDATE x", "SELECT 1 2"} {
+		if _, _, _, err := ParseCommandComplete(tag); err == nil {
+			t.Fatalf("%q should be invalid", tag)
+		}
+	}
+}
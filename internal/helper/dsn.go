@@ -8,6 +8,7 @@ package helper
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"os/user"
@@ -16,16 +17,49 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+)
+
+// sslmode 的可选值，含义与libpq一致
+const (
+	SSLModeDisable    = "disable"
+	SSLModeAllow      = "allow"
+	SSLModePrefer     = "prefer"
+	SSLModeRequire    = "require"
+	SSLModeVerifyCA   = "verify-ca"
+	SSLModeVerifyFull = "verify-full"
 )
 
 type DataSourceName struct {
-	Host           string
-	Port           string
-	Password       string
+	Host     string
+	Port     string
+	Password string
+	// connect_timeout，单位秒，为 0 时使用 DefaultConnectTimeout
+	//
+	// Deprecated: 读取请使用 EffectiveConnectTimeout，它会应用默认值。
 	ConnectTimeout time.Duration
-	Parameter      map[string]string
-	IsStrict       bool
-	SSL            struct {
+	// 发送 Terminate 后等待服务端关闭连接的时间
+	TerminateTimeout time.Duration
+	// read_timeout、write_timeout，单位秒，读取一次响应及每次写出消息的超时时间，为 0 时不限制
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// type_refresh_interval，单位秒，DiscoverTypes 之后在后台刷新类型的间隔，为 0 时不刷新
+	TypeRefreshInterval time.Duration
+	// max_result_rows，扩展协议查询每次从服务端获取的最大行数，为 0 时不限制
+	MaxResultRows int
+	// batch_size，BatchInsert 单条语句最多插入的行数，默认 1000
+	BatchSize int
+	// 网络错误（域名解析失败、连接被拒绝）时的重试次数，及首次重试前的等待时间，之后每次加倍
+	ConnectRetries       int
+	ConnectRetryInterval time.Duration
+	// require_database、require_user，启动后确认服务端连接的数据库及用户与数据源一致
+	RequireDatabase bool
+	RequireUser     bool
+	// GSSAPI 认证时的 Kerberos 服务名，默认 postgres
+	KrbSrvName string
+	Parameter  map[string]string
+	IsStrict   bool
+	SSL        struct {
 		Mode        string
 		Cert        string
 		Key         string
@@ -33,16 +67,23 @@ type DataSourceName struct {
 		Crl         string
 		Compression int
 	}
+	// 原始的数据源字符串，仅用于 Redacted
+	raw string
 }
 
 func ParseDSN(connectStr string) (dsn *DataSourceName, err error) {
 	dsn = new(DataSourceName)
 	dsn.setDefault()
+	dsn.raw = connectStr
 	if strings.Contains(connectStr, "://") {
 		err = dsn.parseURI(connectStr)
 	} else {
 		err = dsn.parseDSN(connectStr)
 	}
+	if err == nil && strings.IndexByte(dsn.Password, 0) >= 0 {
+		// 协议中的口令以 NUL 结尾，含 NUL 的口令无法发送
+		err = fmt.Errorf("invalid password: must not contain a NUL byte")
+	}
 	return
 }
 
@@ -54,9 +95,13 @@ func (dsn *DataSourceName) setDefault() {
 	dsn.Parameter["database"] = "postgres"
 	dsn.Parameter["DateStyle"] = "ISO, YMD"
 	dsn.Parameter["client_encoding"] = "UTF8"
-	dsn.ConnectTimeout = time.Duration(60) * time.Second
+	dsn.TerminateTimeout = time.Duration(2) * time.Second
+	dsn.ConnectRetries = 3
+	dsn.BatchSize = 1000
+	dsn.KrbSrvName = "postgres"
+	dsn.ConnectRetryInterval = time.Duration(500) * time.Millisecond
 	dsn.SSL.Compression = 1
-	dsn.SSL.Mode = "prefer"
+	dsn.SSL.Mode = SSLModePrefer
 	u, err := user.Current()
 	if err == nil {
 		dsn.Parameter["user"] = u.Name
@@ -99,20 +144,17 @@ func (dsn *DataSourceName) pickEnv(key string, env []string) string {
 	return ""
 }
 func (dsn *DataSourceName) parseDSN(str string) (err error) {
-	p := make(map[string]string)
-	for _, item := range strings.Split(str, " ") {
-		pair := strings.Split(item, "=")
-		if len(pair) == 2 {
-			p[strings.ToLower(strings.TrimSpace(pair[0]))] = strings.TrimSpace(pair[1])
-		}
+	p, err := splitKeyValue(str)
+	if err != nil {
+		return
 	}
 	if host, has := p["host"]; has {
 		dsn.Host = host
 		delete(p, "host")
 	}
-	if port, has := p["Port"]; has {
+	if port, has := p["port"]; has {
 		dsn.Port = port
-		delete(p, "Port")
+		delete(p, "port")
 	}
 	if u, has := p["user"]; has {
 		dsn.Parameter["user"] = u
@@ -126,13 +168,7 @@ func (dsn *DataSourceName) parseDSN(str string) (err error) {
 		dsn.Parameter["database"] = dbName
 		delete(p, "dbname")
 	}
-	if appName, has := p["application_name"]; has {
-		dsn.Parameter["application_name"] = appName
-		delete(p, "application_name")
-	} else if appName, has := p["fallback_application_name"]; has {
-		dsn.Parameter["application_name"] = appName
-		delete(p, "fallback_application_name")
-	}
+	dsn.pickApplicationName(&p)
 	if tos, has := p["connect_timeout"]; has {
 		to, err := strconv.Atoi(tos)
 		if err != nil {
@@ -141,11 +177,36 @@ func (dsn *DataSourceName) parseDSN(str string) (err error) {
 		dsn.ConnectTimeout = time.Duration(to) * time.Second
 		delete(p, "connect_timeout")
 	}
+	if tos, has := p["terminate_timeout"]; has {
+		to, err := strconv.Atoi(tos)
+		if err != nil {
+			return err
+		}
+		dsn.TerminateTimeout = time.Duration(to) * time.Second
+		delete(p, "terminate_timeout")
+	}
 	if strict, has := p["strict"]; has {
 		dsn.IsStrict = strict == "true"
 		delete(p, "strict")
 	}
 
+	if err = dsn.pickConnectRetry(&p); err != nil {
+		return
+	}
+	if err = dsn.pickDurations(&p); err != nil {
+		return
+	}
+	if err = dsn.pickRequire(&p); err != nil {
+		return
+	}
+	if err = dsn.pickLimits(&p); err != nil {
+		return
+	}
+	if v, has := p["krbsrvname"]; has {
+		dsn.KrbSrvName = v
+		delete(p, "krbsrvname")
+	}
+	dsn.pickSearchPath(&p)
 	dsn.pickSSLSetting(&p)
 
 	for k, v := range p {
@@ -154,9 +215,105 @@ func (dsn *DataSourceName) parseDSN(str string) (err error) {
 	return
 }
 
+// splitKeyValue 按libpq的规则拆分 key=value 形式的数据源：
+// 等号两侧可有空格，值中含空格时用单引号包裹，\ 转义单引号及反斜杠本身。
+// 如：options='-c search_path=public -c statement_timeout=5000'
+func splitKeyValue(str string) (p map[string]string, err error) {
+	pairs, err := tokenizeKeyValue(str)
+	if err != nil {
+		return
+	}
+	p = make(map[string]string, len(pairs))
+	for _, kv := range pairs {
+		p[kv.key] = kv.value
+	}
+	return
+}
+
+type keyValue struct {
+	key, value string
+}
+
+// tokenizeKeyValue 按出现顺序返回数据源中的键值对，key 已转为小写，value 已去掉引号及转义
+func tokenizeKeyValue(str string) (pairs []keyValue, err error) {
+	var rs = []rune(str)
+	var i = 0
+	var skipSpace = func() {
+		for i < len(rs) && unicode.IsSpace(rs[i]) {
+			i++
+		}
+	}
+	for {
+		skipSpace()
+		if i >= len(rs) {
+			return
+		}
+		var key []rune
+		var start = i
+		for i < len(rs) && rs[i] != '=' && !unicode.IsSpace(rs[i]) {
+			key = append(key, rs[i])
+			i++
+		}
+		skipSpace()
+		if i >= len(rs) || rs[i] != '=' {
+			// 不回显 key：格式错误时它可能是密码的一部分
+			return nil, fmt.Errorf("missing \"=\" after key at offset %d in connection info string", start)
+		}
+		i++
+		skipSpace()
+		var value []rune
+		if i < len(rs) && rs[i] == '\'' {
+			i++
+			for ; ; i++ {
+				if i >= len(rs) {
+					return nil, fmt.Errorf("unterminated quoted string in connection info string")
+				}
+				if rs[i] == '\\' && i+1 < len(rs) {
+					i++
+				} else if rs[i] == '\'' {
+					i++
+					break
+				}
+				value = append(value, rs[i])
+			}
+		} else {
+			for ; i < len(rs) && !unicode.IsSpace(rs[i]); i++ {
+				if rs[i] == '\\' && i+1 < len(rs) {
+					i++
+				}
+				value = append(value, rs[i])
+			}
+		}
+		pairs = append(pairs, keyValue{strings.ToLower(string(key)), string(value)})
+	}
+}
+
+// quoteKeyValue 按 tokenizeKeyValue 的规则引用值，空值及含空格、引号、反斜杠的值用单引号包裹
+func quoteKeyValue(v string) string {
+	if v != "" && strings.IndexFunc(v, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '\'' || r == '\\'
+	}) < 0 {
+		return v
+	}
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range v {
+		if r == '\'' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
 func (dsn *DataSourceName) parseURI(uri string) (err error) {
 	u, err := url.Parse(uri)
 	if err != nil {
+		// url.Error 会带上完整的 URI，其中可能含有密码
+		if ue, ok := err.(*url.Error); ok {
+			err = fmt.Errorf("invalid connection URI: %v", ue.Err)
+		}
 		return
 	}
 	if u.Scheme != "postgres" && u.Scheme != "postgresql" && u.Scheme != "pg" {
@@ -194,15 +351,17 @@ func (dsn *DataSourceName) parseURI(uri string) (err error) {
 		dsn.ConnectTimeout = time.Duration(to) * time.Second
 		delete(qm, "connect_timeout")
 	}
-
-	if appName, has := qm["application_name"]; has {
-		dsn.Parameter["application_name"] = appName
-		delete(qm, "application_name")
-	} else if appName, has := qm["fallback_application_name"]; has {
-		dsn.Parameter["application_name"] = appName
-		delete(qm, "fallback_application_name")
+	if tos, has := qm["terminate_timeout"]; has {
+		to, err := strconv.Atoi(tos)
+		if err != nil {
+			return err
+		}
+		dsn.TerminateTimeout = time.Duration(to) * time.Second
+		delete(qm, "terminate_timeout")
 	}
 
+	dsn.pickApplicationName(&qm)
+
 	if host, has := qm["host"]; has {
 		dsn.Host = host
 		delete(qm, "host")
@@ -212,6 +371,23 @@ func (dsn *DataSourceName) parseURI(uri string) (err error) {
 		delete(qm, "strict")
 	}
 
+	if err = dsn.pickConnectRetry(&qm); err != nil {
+		return
+	}
+	if err = dsn.pickDurations(&qm); err != nil {
+		return
+	}
+	if err = dsn.pickRequire(&qm); err != nil {
+		return
+	}
+	if err = dsn.pickLimits(&qm); err != nil {
+		return
+	}
+	if v, has := qm["krbsrvname"]; has {
+		dsn.KrbSrvName = v
+		delete(qm, "krbsrvname")
+	}
+	dsn.pickSearchPath(&qm)
 	dsn.pickSSLSetting(&qm)
 
 	for k, v := range qm {
@@ -220,10 +396,123 @@ func (dsn *DataSourceName) parseURI(uri string) (err error) {
 	return
 }
 
+// connect_retries 为重试次数，connect_retry_interval 为首次重试前等待的毫秒数
+func (dsn *DataSourceName) pickConnectRetry(envs *map[string]string) error {
+	if v, has := (*envs)["connect_retries"]; has {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid connect_retries: %q", v)
+		}
+		dsn.ConnectRetries = n
+		delete(*envs, "connect_retries")
+	}
+	if v, has := (*envs)["connect_retry_interval"]; has {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return fmt.Errorf("invalid connect_retry_interval: %q", v)
+		}
+		dsn.ConnectRetryInterval = time.Duration(ms) * time.Millisecond
+		delete(*envs, "connect_retry_interval")
+	}
+	return nil
+}
+
+// read_timeout、write_timeout 及 type_refresh_interval，单位秒
+func (dsn *DataSourceName) pickDurations(envs *map[string]string) error {
+	for key, d := range map[string]*time.Duration{
+		"read_timeout":          &dsn.ReadTimeout,
+		"write_timeout":         &dsn.WriteTimeout,
+		"type_refresh_interval": &dsn.TypeRefreshInterval,
+	} {
+		if v, has := (*envs)[key]; has {
+			to, err := strconv.Atoi(v)
+			if err != nil || to < 0 {
+				return fmt.Errorf("invalid %v: %q", key, v)
+			}
+			*d = time.Duration(to) * time.Second
+			delete(*envs, key)
+		}
+	}
+	return nil
+}
+
+// require_database、require_user 取值同 strconv.ParseBool
+func (dsn *DataSourceName) pickRequire(envs *map[string]string) error {
+	for key, b := range map[string]*bool{
+		"require_database": &dsn.RequireDatabase,
+		"require_user":     &dsn.RequireUser,
+	} {
+		if v, has := (*envs)[key]; has {
+			var err error
+			if *b, err = strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("invalid %v: %q", key, v)
+			}
+			delete(*envs, key)
+		}
+	}
+	return nil
+}
+
+// max_result_rows 可为 0，batch_size 至少为 1
+func (dsn *DataSourceName) pickLimits(envs *map[string]string) error {
+	for key, limit := range map[string]struct {
+		n   *int
+		min int
+	}{
+		"max_result_rows": {&dsn.MaxResultRows, 0},
+		"batch_size":      {&dsn.BatchSize, 1},
+	} {
+		if v, has := (*envs)[key]; has {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < limit.min {
+				return fmt.Errorf("invalid %v: %q", key, v)
+			}
+			*limit.n = n
+			delete(*envs, key)
+		}
+	}
+	return nil
+}
+
+// pickApplicationName 按 libpq 的优先级确定 application_name：数据源中的 application_name、
+// 环境变量 PGAPPNAME、数据源中的 fallback_application_name、程序名。
+// fallback_application_name 只在客户端生效，服务端不认识该参数，不随启动消息发送
+func (dsn *DataSourceName) pickApplicationName(envs *map[string]string) {
+	var appName, has = (*envs)["application_name"]
+	if !has {
+		appName, has = os.LookupEnv("PGAPPNAME")
+	}
+	if !has {
+		appName, has = (*envs)["fallback_application_name"]
+	}
+	if !has && len(os.Args) > 0 {
+		appName = filepath.Base(os.Args[0])
+	}
+	if appName != "" {
+		dsn.Parameter["application_name"] = appName
+	}
+	delete(*envs, "application_name")
+	delete(*envs, "fallback_application_name")
+}
+
+// search_path 以逗号分隔多个模式名，可包含 $user，随启动消息发送给服务端
+func (dsn *DataSourceName) pickSearchPath(envs *map[string]string) {
+	if v, has := (*envs)["search_path"]; has {
+		var schemas []string
+		for _, schema := range strings.Split(v, ",") {
+			if schema = strings.TrimSpace(schema); schema != "" {
+				schemas = append(schemas, schema)
+			}
+		}
+		dsn.Parameter["search_path"] = strings.Join(schemas, ",")
+		delete(*envs, "search_path")
+	}
+}
+
 func (dsn *DataSourceName) pickSSLSetting(envs *map[string]string) {
 	if envs != nil {
 		if strings.HasPrefix(dsn.Host, "/") {
-			dsn.SSL.Mode = "disable"
+			dsn.SSL.Mode = SSLModeDisable
 		} else if v, has := (*envs)["sslmode"]; has {
 			dsn.SSL.Mode = v
 			delete(*envs, "sslmode")
@@ -253,14 +542,98 @@ func (dsn *DataSourceName) pickSSLSetting(envs *map[string]string) {
 	}
 }
 
+// Clone 深拷贝，修改副本的 Parameter 不影响原值
+func (dsn *DataSourceName) Clone() *DataSourceName {
+	var c = *dsn
+	c.Parameter = make(map[string]string, len(dsn.Parameter))
+	for k, v := range dsn.Parameter {
+		c.Parameter[k] = v
+	}
+	return &c
+}
+
+// With 返回覆盖了一个启动参数的副本，key 为启动消息中的参数名，如 search_path、application_name
+func (dsn *DataSourceName) With(key, value string) *DataSourceName {
+	var c = dsn.Clone()
+	c.Parameter[key] = value
+	return c
+}
+
+// Without 返回去掉了一个启动参数的副本
+func (dsn *DataSourceName) Without(key string) *DataSourceName {
+	var c = dsn.Clone()
+	delete(c.Parameter, key)
+	return c
+}
+
+// DefaultConnectTimeout 未指定 connect_timeout 或其为 0 时的连接超时
+const DefaultConnectTimeout = time.Duration(30) * time.Second
+
+// EffectiveConnectTimeout 返回建立连接（含重试）的超时
+func (dsn *DataSourceName) EffectiveConnectTimeout() time.Duration {
+	if dsn.ConnectTimeout <= 0 {
+		return DefaultConnectTimeout
+	}
+	return dsn.ConnectTimeout
+}
+
+// Address 返回拨号参数，可直接展开传给 PgIO.Dial。与 libpq 一致，以 / 开头的 host 视为 Unix 域套接字所在目录；
+// IPv6 地址会加上方括号，如 [::1]:5432
 func (dsn *DataSourceName) Address() (network, address string, timeout time.Duration) {
 	if strings.HasPrefix(dsn.Host, "/") {
 		network = "unix"
-		address = dsn.Host + "/.s.PGSQL." + dsn.Port
+		address = strings.TrimSuffix(dsn.Host, "/") + "/.s.PGSQL." + dsn.Port
 	} else {
 		network = "tcp"
-		address = dsn.Host + ":" + dsn.Port
+		address = net.JoinHostPort(dsn.Host, dsn.Port)
 	}
-	timeout = dsn.ConnectTimeout
+	timeout = dsn.EffectiveConnectTimeout()
 	return
 }
+
+const redactedPassword = "*****"
+
+// String 同 Redacted，避免以 %v、%s 格式化时泄露密码。值接收者使 DataSourceName 及其指针都适用
+func (dsn DataSourceName) String() string {
+	return dsn.Redacted()
+}
+
+// GoString 同 Redacted，避免以 %#v 格式化时输出 Password 字段
+func (dsn DataSourceName) GoString() string {
+	return dsn.Redacted()
+}
+
+// Redacted 返回隐去密码的数据源字符串，可安全地用于日志及错误信息
+func (dsn *DataSourceName) Redacted() string {
+	if strings.Contains(dsn.raw, "://") {
+		u, err := url.Parse(dsn.raw)
+		if err != nil {
+			return ""
+		}
+		if _, has := u.User.Password(); has {
+			u.User = url.UserPassword(u.User.Username(), redactedPassword)
+		}
+		var q = u.Query()
+		for k := range q {
+			if strings.ToLower(k) == "password" {
+				q.Set(k, redactedPassword)
+			}
+		}
+		u.RawQuery = q.Encode()
+		// url 会把 * 转义为 %2A，还原以便阅读
+		return strings.Replace(u.String(), url.QueryEscape(redactedPassword), redactedPassword, -1)
+	}
+	// 由拆分结果重新拼接，而不是在原串上替换，引号、转义及等号两侧的空格都不会漏出密码
+	pairs, err := tokenizeKeyValue(dsn.raw)
+	if err != nil {
+		return ""
+	}
+	var items = make([]string, len(pairs))
+	for i, kv := range pairs {
+		if kv.key == "password" {
+			kv.value = redactedPassword
+		}
+		items[i] = kv.key + "=" + quoteKeyValue(kv.value)
+	}
+	return strings.Join(items, " ")
+}
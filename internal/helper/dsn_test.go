@@ -7,7 +7,11 @@
 package helper
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,7 +21,7 @@ func TestParseDSNUseURI(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	log.Println(dsn)
+	log.Println(dsn.Redacted())
 }
 
 func TestParseDSNUseURIHasSock(t *testing.T) {
@@ -34,7 +38,38 @@ func TestParseDSNUseURIHasSock(t *testing.T) {
 	if dsn.Host != name.Host {
 		t.Fail()
 	}
-	log.Println(dsn)
+	log.Println(dsn.Redacted())
+}
+
+func TestAddress(t *testing.T) {
+	dsn, err := ParseDSN("host=/var/run/postgresql port=5433 user=postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network, address, _ := dsn.Address(); network != "unix" || address != "/var/run/postgresql/.s.PGSQL.5433" {
+		t.Fatal(network, address)
+	}
+	dsn, err = ParseDSN("pg://postgres@localhost:5433/db_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network, address, _ := dsn.Address(); network != "tcp" || address != "localhost:5433" {
+		t.Fatal(network, address)
+	}
+	dsn, err = ParseDSN("host=/var/run/postgresql/ user=postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network, address, _ := dsn.Address(); network != "unix" || address != "/var/run/postgresql/.s.PGSQL.5432" {
+		t.Fatal(network, address)
+	}
+	dsn, err = ParseDSN("pg://postgres@[::1]:5433/db_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network, address, _ := dsn.Address(); network != "tcp" || address != "[::1]:5433" {
+		t.Fatal(network, address)
+	}
 }
 
 func TestParseDSNUseStr(t *testing.T) {
@@ -67,5 +102,304 @@ func TestParseDSNUseStrHasSock(t *testing.T) {
 	if dsn.Host != name.Host {
 		t.Fail()
 	}
-	log.Println(dsn)
+	log.Println(dsn.Redacted())
+}
+
+func TestRedacted(t *testing.T) {
+	dsn, err := ParseDSN("pg://postgres:p%40ss%3Aw0rd%21@localhost:5432/db_name?application_name=app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.Password != "p@ss:w0rd!" {
+		t.Fatal(dsn.Password)
+	}
+	if r := dsn.Redacted(); r != "pg://postgres:*****@localhost:5432/db_name?application_name=app" {
+		t.Fatal(r)
+	}
+
+	dsn, err = ParseDSN("user=postgres password=p@ss:w0rd! host=localhost dbname=db_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := dsn.Redacted(); r != "user=postgres password=***** host=localhost dbname=db_name" {
+		t.Fatal(r)
+	}
+
+	var cases = []struct {
+		in, out string
+	}{
+		{`user=postgres password='se cret' host=localhost`, `user=postgres password=***** host=localhost`},
+		{`user=postgres password = secret host=localhost`, `user=postgres password=***** host=localhost`},
+		{`user=postgres password='se\'cret' host=localhost`, `user=postgres password=***** host=localhost`},
+		{`password=secret options='-c search_path=public'`, `password=***** options='-c search_path=public'`},
+	}
+	for _, c := range cases {
+		dsn, err = ParseDSN(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := dsn.Redacted(); r != c.out {
+			t.Fatal(c.in, r)
+		}
+		// 重新拼接的结果仍可被解析，参数不变
+		again, err := ParseDSN(dsn.Redacted())
+		if err != nil || again.Parameter["options"] != dsn.Parameter["options"] {
+			t.Fatal(err, again.Parameter)
+		}
+	}
+}
+
+func TestParseDSNPasswordNul(t *testing.T) {
+	for _, str := range []string{
+		"pg://postgres:se%00cret@localhost/db_name",
+		"user=postgres password='se\x00cret'",
+	} {
+		if _, err := ParseDSN(str); err == nil || strings.Contains(err.Error(), "cret") {
+			t.Fatal(str, err)
+		}
+	}
+}
+
+func TestParseDSNSearchPath(t *testing.T) {
+	dsn, err := ParseDSN("pg://postgres@localhost/db_name?search_path=tenant_1,%20$user,%20public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.Parameter["search_path"] != "tenant_1,$user,public" {
+		t.Fatal(dsn.Parameter["search_path"])
+	}
+}
+
+func TestParseDSNOptions(t *testing.T) {
+	dsn, err := ParseDSN(`user=postgres options='-c synchronous_commit=off -c default_transaction_isolation=serializable' password = 'it\'s' port=5433`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.Parameter["options"] != "-c synchronous_commit=off -c default_transaction_isolation=serializable" {
+		t.Fatal(dsn.Parameter["options"])
+	}
+	if dsn.Password != "it's" || dsn.Port != "5433" {
+		t.Fatal(dsn.Password, dsn.Port)
+	}
+
+	dsn, err = ParseDSN("pg://postgres@localhost/db_name?options=-c%20synchronous_commit%3Doff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.Parameter["options"] != "-c synchronous_commit=off" {
+		t.Fatal(dsn.Parameter["options"])
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	for str, want := range map[string]time.Duration{
+		"user=postgres":                                     DefaultConnectTimeout,
+		"user=postgres connect_timeout=0":                   DefaultConnectTimeout,
+		"user=postgres connect_timeout=5":                   5 * time.Second,
+		"pg://postgres@localhost/db_name?connect_timeout=7": 7 * time.Second,
+	} {
+		dsn, err := ParseDSN(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dsn.EffectiveConnectTimeout() != want {
+			t.Fatal(str, dsn.EffectiveConnectTimeout())
+		}
+		if _, _, timeout := dsn.Address(); timeout != want {
+			t.Fatal(str, timeout)
+		}
+	}
+}
+
+func TestParseDSNConnectRetry(t *testing.T) {
+	dsn, err := ParseDSN("pg://postgres@localhost/db_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.ConnectRetries != 3 || dsn.ConnectRetryInterval != 500*time.Millisecond {
+		t.Fatal(dsn.ConnectRetries, dsn.ConnectRetryInterval)
+	}
+	dsn, err = ParseDSN("user=postgres connect_retries=5 connect_retry_interval=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.ConnectRetries != 5 || dsn.ConnectRetryInterval != 100*time.Millisecond {
+		t.Fatal(dsn.ConnectRetries, dsn.ConnectRetryInterval)
+	}
+	if _, has := dsn.Parameter["connect_retries"]; has {
+		t.Fatal("connect_retries must not be sent to the server")
+	}
+	if _, err = ParseDSN("user=postgres connect_retries=-1"); err == nil {
+		t.Fatal("negative connect_retries")
+	}
+}
+
+func TestParseDSNDurations(t *testing.T) {
+	dsn, err := ParseDSN("pg://postgres@localhost/db_name?read_timeout=9&write_timeout=3&type_refresh_interval=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.ReadTimeout != 9*time.Second || dsn.WriteTimeout != 3*time.Second || dsn.TypeRefreshInterval != time.Minute {
+		t.Fatal(dsn.ReadTimeout, dsn.WriteTimeout, dsn.TypeRefreshInterval)
+	}
+	if _, has := dsn.Parameter["write_timeout"]; has {
+		t.Fatal("write_timeout must not be sent to the server")
+	}
+	if _, err = ParseDSN("user=postgres write_timeout=x"); err == nil {
+		t.Fatal("invalid write_timeout")
+	}
+}
+
+func TestParseDSNRequireAndLimits(t *testing.T) {
+	dsn, err := ParseDSN("pg://postgres@localhost/db_name?require_database=true&require_user=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dsn.RequireDatabase || !dsn.RequireUser {
+		t.Fatal(dsn.RequireDatabase, dsn.RequireUser)
+	}
+	if _, has := dsn.Parameter["require_database"]; has {
+		t.Fatal("require_database must not be sent to the server")
+	}
+	if _, err = ParseDSN("user=postgres require_user=yes"); err == nil {
+		t.Fatal("invalid require_user")
+	}
+
+	dsn, err = ParseDSN("user=postgres max_result_rows=500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.MaxResultRows != 500 {
+		t.Fatal(dsn.MaxResultRows)
+	}
+	if _, err = ParseDSN("user=postgres max_result_rows=-1"); err == nil {
+		t.Fatal("negative max_result_rows")
+	}
+
+	if dsn.BatchSize != 1000 {
+		t.Fatal(dsn.BatchSize)
+	}
+	dsn, err = ParseDSN("pg://postgres@localhost/postgres?batch_size=200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.BatchSize != 200 {
+		t.Fatal(dsn.BatchSize)
+	}
+	if _, has := dsn.Parameter["batch_size"]; has {
+		t.Fatal("batch_size must not be sent to the server")
+	}
+	if _, err = ParseDSN("user=postgres batch_size=0"); err == nil {
+		t.Fatal("zero batch_size")
+	}
+}
+
+func TestParseDSNApplicationName(t *testing.T) {
+	var pgAppName, hasEnv = os.LookupEnv("PGAPPNAME")
+	_ = os.Unsetenv("PGAPPNAME")
+	defer func() {
+		if hasEnv {
+			_ = os.Setenv("PGAPPNAME", pgAppName)
+		}
+	}()
+
+	for str, want := range map[string]string{
+		"user=postgres application_name=app fallback_application_name=lib":                   "app",
+		"user=postgres fallback_application_name=lib":                                        "lib",
+		"pg://postgres@localhost/db_name?fallback_application_name=lib":                      "lib",
+		"pg://postgres@localhost/db_name?application_name=app&fallback_application_name=lib": "app",
+		"user=postgres": filepath.Base(os.Args[0]),
+	} {
+		dsn, err := ParseDSN(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dsn.Parameter["application_name"] != want {
+			t.Fatal(str, dsn.Parameter["application_name"])
+		}
+		if _, has := dsn.Parameter["fallback_application_name"]; has {
+			t.Fatal(str, "fallback_application_name must not be sent to the server")
+		}
+	}
+
+	_ = os.Setenv("PGAPPNAME", "env")
+	dsn, err := ParseDSN("user=postgres fallback_application_name=lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.Parameter["application_name"] != "env" {
+		t.Fatal(dsn.Parameter["application_name"])
+	}
+	_ = os.Unsetenv("PGAPPNAME")
+}
+
+func TestDSNWith(t *testing.T) {
+	base, err := ParseDSN("pg://postgres@localhost/db_name?search_path=public&application_name=app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := base.With("search_path", "tenant_1")
+	if tenant.Parameter["search_path"] != "tenant_1" || base.Parameter["search_path"] != "public" {
+		t.Fatal(tenant.Parameter, base.Parameter)
+	}
+	if tenant.Host != base.Host || tenant.Parameter["database"] != "db_name" {
+		t.Fatal(tenant)
+	}
+	anon := tenant.Without("application_name")
+	if _, has := anon.Parameter["application_name"]; has {
+		t.Fatal(anon.Parameter)
+	}
+	if tenant.Parameter["application_name"] != "app" {
+		t.Fatal(tenant.Parameter)
+	}
+	clone := base.Clone()
+	clone.SSL.Mode = SSLModeDisable
+	if base.SSL.Mode == SSLModeDisable {
+		t.Fatal("clone shares SSL settings")
+	}
+}
+
+func TestDSNErrorsRedacted(t *testing.T) {
+	for _, str := range []string{
+		"user=postgres password=se cret",
+		"pg://postgres:secret@localhost:bad/db_name",
+		"pg://postgres:secret@local host/db_name",
+	} {
+		_, err := ParseDSN(str)
+		if err == nil {
+			t.Fatal(str)
+		}
+		if strings.Contains(err.Error(), "secret") || strings.Contains(err.Error(), "cret") {
+			t.Fatal(err)
+		}
+	}
+	dsn, err := ParseDSN("pg://postgres:secret@localhost/db_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := fmt.Sprintf("%v", dsn); strings.Contains(v, "secret") {
+		t.Fatal(v)
+	}
+}
+
+// 各种格式化动词的输出中都不得出现密码
+func TestDSNFormatRedacted(t *testing.T) {
+	for _, str := range []string{
+		"pg://postgres:secret@localhost/db_name",
+		"user=postgres password=secret host=localhost",
+	} {
+		dsn, err := ParseDSN(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{
+			fmt.Sprintf("%v", dsn), fmt.Sprintf("%+v", dsn), fmt.Sprintf("%s", dsn), fmt.Sprintf("%#v", dsn),
+			fmt.Sprintf("%v", *dsn), fmt.Sprintf("%+v", *dsn), fmt.Sprint(dsn), fmt.Sprintln(dsn),
+			fmt.Errorf("connect %v: refused", dsn).Error(),
+		} {
+			if strings.Contains(v, "secret") || !strings.Contains(v, redactedPassword) {
+				t.Fatal(v)
+			}
+		}
+	}
 }
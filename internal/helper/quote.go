@@ -0,0 +1,35 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package helper
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNulInString 协议中的字符串以 NUL 结尾，本身不能含 NUL，否则会被截断
+var ErrNulInString = errors.New("pg: string must not contain a NUL byte")
+
+// QuoteIdentifier 把名称转为带双引号的 SQL 标识符，双引号写两次，区分大小写。
+// 名称含 NUL 时返回 ErrNulInString，而不是截断成另一个名称
+func QuoteIdentifier(name string) (string, error) {
+	if strings.IndexByte(name, 0) >= 0 {
+		return "", ErrNulInString
+	}
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`, nil
+}
+
+// QuoteLiteral 把字符串转为 SQL 字符串常量，用于无法绑定参数的语句（如 EXECUTE、DDL）。
+// 单引号写两次；含反斜杠时使用 E'' 形式并转义反斜杠，
+// 因此无论 standard_conforming_strings 取何值结果都相同
+func QuoteLiteral(literal string) string {
+	literal = strings.Replace(literal, `'`, `''`, -1)
+	if strings.Contains(literal, `\`) {
+		return `E'` + strings.Replace(literal, `\`, `\\`, -1) + `'`
+	}
+	return `'` + literal + `'`
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package helper
+
+import "testing"
+
+func TestQuoteLiteral(t *testing.T) {
+	var cases = []struct {
+		in, out string
+	}{
+		{"", `''`},
+		{"abc", `'abc'`},
+		{"it's", `'it''s'`},
+		{`a\b`, `E'a\\b'`},
+		{`'; drop table t; --\`, `E'''; drop table t; --\\'`},
+	}
+	for _, c := range cases {
+		if v := QuoteLiteral(c.in); v != c.out {
+			t.Fatal(c.in, v)
+		}
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	var cases = []struct {
+		in, out string
+	}{
+		{"users", `"users"`},
+		{"Users", `"Users"`},
+		{`say "hi"`, `"say ""hi"""`},
+		{`t"; drop table t; --`, `"t""; drop table t; --"`},
+	}
+	for _, c := range cases {
+		if v, err := QuoteIdentifier(c.in); err != nil || v != c.out {
+			t.Fatal(c.in, v, err)
+		}
+	}
+	if _, err := QuoteIdentifier("a\x00b"); err != ErrNulInString {
+		t.Fatal(err)
+	}
+}
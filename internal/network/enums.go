@@ -40,6 +40,7 @@ const (
 	IdentifiesFunctionCall         = 'F'
 	IdentifiesFunctionCallResponse = 'V'
 	IdentifiesGSSResponse          = 'p'
+	IdentifiesNegotiateProtocol    = 'v'
 	IdentifiesNoData               = 'n'
 	IdentifiesNoticeResponse       = 'N'
 	IdentifiesNotificationResponse = 'A'
@@ -59,3 +60,18 @@ const (
 	IdentifiesSync                 = 'S'
 	IdentifiesTerminate            = 'X'
 )
+
+// validateIdentifies 检查服务端消息的类型字节。未知的类型说明数据流已错位，其后的长度字段不可信
+func validateIdentifies(id byte) bool {
+	switch id {
+	case IdentifiesAuth, IdentifiesBackendKeyData, IdentifiesBindComplete, IdentifiesCloseComplete,
+		IdentifiesCommandComplete, IdentifiesCopyData, IdentifiesCopyDone, IdentifiesCopyInResponse,
+		IdentifiesCopyOutResponse, IdentifiesCopyBothResponse, IdentifiesDataRow, IdentifiesEmptyQueryResponse,
+		IdentifiesErrorResponse, IdentifiesFunctionCallResponse, IdentifiesNegotiateProtocol, IdentifiesNoData,
+		IdentifiesNoticeResponse, IdentifiesNotificationResponse, IdentifiesParameterDescription,
+		IdentifiesParameterStatus, IdentifiesParseComplete, IdentifiesPortalSuspended, IdentifiesReadyForQuery,
+		IdentifiesRowDescription:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import "fmt"
+
+// BatchEntry ParseBatch 中要预备的一条语句
+type BatchEntry struct {
+	Name string
+	SQL  string
+}
+
+// BatchResult 与 BatchEntry 按下标一一对应
+type BatchResult struct {
+	Columns        []PgColumn
+	ParameterTypes []uint32
+	Err            error
+}
+
+// BatchStmt ParseAndExecBatch 中要执行的一条语句。SQL 为空时执行已预备的 Name 语句，
+// 否则以 Name 预备 SQL，Name 为空时使用未命名语句
+type BatchStmt struct {
+	Name string
+	SQL  string
+	Args []interface{}
+}
+
+// BatchError ParseAndExecBatch 中第 Index 条语句出错，其后的语句均未执行
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("pg: batch statement %d: %v", e.Index, e.Err)
+}
@@ -6,12 +6,84 @@
 
 package network
 
+// 列的传输格式
+const (
+	FormatText   = 0
+	FormatBinary = 1
+)
+
 type PgColumn struct {
-	Name         string
-	TableOid     uint32
-	Index        uint16
-	TypeOid      uint32
-	Len          uint16
-	TypeModifier uint32
-	Format       uint16
+	Name string
+	// 来源表的 oid，非表字段（表达式、函数结果等）时为 0
+	TableOID uint32
+	// 来源字段在表中的序号（pg_attribute.attnum），非表字段时为 0
+	AttributeNumber uint16
+	TypeOid         uint32
+	Len             uint16
+	// 类型修饰符（pg_attribute.atttypmod），未声明精度、长度时为 -1
+	TypeModifier int32
+	FormatCode   uint16
+}
+
+// TypeModifier 相关类型的 oid
+const (
+	oidBpchar     = 1042
+	oidVarchar    = 1043
+	oidNumeric    = 1700
+	oidArrBpchar  = 1014
+	oidArrVarchar = 1015
+	oidArrNumeric = 1231
+)
+
+// TypeModifier 为负数时表示未声明；否则包含 4 字节的头部长度
+const typeModifierHeader = 4
+
+// NumericPrecision numeric(p,s) 的精度 p，即 (TypeModifier - 4) 的高 16 位。非 numeric 或未声明精度时 ok 为 false
+func (c PgColumn) NumericPrecision() (int, bool) {
+	if !c.isNumeric() {
+		return 0, false
+	}
+	return int((c.TypeModifier - typeModifierHeader) >> 16 & 0xffff), true
+}
+
+// NumericScale numeric(p,s) 的小数位数 s，即 (TypeModifier - 4) 的低 16 位。非 numeric 或未声明精度时 ok 为 false
+func (c PgColumn) NumericScale() (int, bool) {
+	if !c.isNumeric() {
+		return 0, false
+	}
+	return int((c.TypeModifier - typeModifierHeader) & 0xffff), true
+}
+
+func (c PgColumn) isNumeric() bool {
+	return (c.TypeOid == oidNumeric || c.TypeOid == oidArrNumeric) && c.TypeModifier >= 0
+}
+
+// CharMaxLength varchar(n)、char(n) 的长度 n。其它类型或未声明长度时 ok 为 false
+func (c PgColumn) CharMaxLength() (int, bool) {
+	switch c.TypeOid {
+	case oidBpchar, oidVarchar, oidArrBpchar, oidArrVarchar:
+		if c.TypeModifier < 0 {
+			return 0, false
+		}
+		return int(c.TypeModifier - typeModifierHeader), true
+	}
+	return 0, false
+}
+
+// IsExpression 该列不直接来自某张表的字段
+func (c PgColumn) IsExpression() bool {
+	return c.TableOID == 0
+}
+
+// RowDescriptionChanged 比较两次得到的结果列，列数、列名、类型或格式任一不同即为变化
+func RowDescriptionChanged(old, new []PgColumn) bool {
+	if len(old) != len(new) {
+		return true
+	}
+	for i := range old {
+		if old[i] != new[i] {
+			return true
+		}
+	}
+	return false
 }
@@ -8,13 +8,59 @@ package network
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
+// ErrStatementNotFound Describe 的预备语句在服务端不存在（SQLSTATE 26000）
+var ErrStatementNotFound = errors.New("pg: prepared statement does not exist")
+
+// ErrColumnLayoutChanged 表结构变更使预备语句的结果列发生了变化，缓存的列已更新，
+// 调用方应刷新列到结构体字段的映射后重试。实际返回的是 *ColumnLayoutChangedError，以 errors.Is 判断
+var ErrColumnLayoutChanged = errors.New("pg: result column layout of prepared statement changed")
+
+// ColumnLayoutChangedError 结果列变化时返回，Err 为服务端原始的 0A000 错误，可经 errors.As 取得
+type ColumnLayoutChangedError struct {
+	Err *PgError
+}
+
+func (e *ColumnLayoutChangedError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrColumnLayoutChanged, e.Err)
+}
+
+func (e *ColumnLayoutChangedError) Unwrap() error {
+	return e.Err
+}
+
+// Is 使 errors.Is(err, ErrColumnLayoutChanged) 成立
+func (e *ColumnLayoutChangedError) Is(target error) bool {
+	return target == ErrColumnLayoutChanged
+}
+
+// ErrCancelNotSupported 启动时服务端（或中间的连接池）没有发送 BackendKeyData，无法取消查询
+var ErrCancelNotSupported = errors.New("pg: server did not send BackendKeyData, cancel is not supported")
+
+// ErrCancelPending 查询期间发出过 CancelRequest，服务端可能稍后才处理，连接不再复用
+var ErrCancelPending = errors.New("pg: a cancel request may still be pending on the server, connection discarded")
+
+// ErrPortalSuspended ParseQueryFetchContext 挂起的门户尚未读完或关闭、且未以 SetPortalDrain 设置处理函数时，
+// 不能在同一连接上开始新的请求
+var ErrPortalSuspended = errors.New("pg: a suspended portal is still open, read or close the rows first")
+
+// ErrProtocolViolation 收到未知类型的消息，数据流已错位，连接不可恢复，应直接丢弃
+var ErrProtocolViolation = errors.New("pg: protocol violation: unexpected message type from server")
+
+// ErrWrongDatabase、ErrWrongUser 启用 require_database、require_user 时，服务端连接的数据库或用户与数据源不符
+var (
+	ErrWrongDatabase = errors.New("pg: connected to an unexpected database")
+	ErrWrongUser     = errors.New("pg: connected as an unexpected user")
+)
+
 type PgError struct {
 	Severity         string `json:"severity"`
 	Text             string `json:"text"`
 	Code             int    `json:"code"`
+	SQLState         string `json:"sql_state"`
 	Message          string `json:"message"`
 	Detail           string `json:"detail"`
 	Hint             string `json:"hint"`
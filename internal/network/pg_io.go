@@ -13,141 +13,610 @@ import (
 	"crypto/tls"
 	"database/sql/driver"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/blusewang/pg/internal/helper"
 	"io"
+	"io/ioutil"
 	"net"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 func NewPgIO(dsn *helper.DataSourceName) *PgIO {
 	pi := new(PgIO)
 	pi.dsn = dsn
+	if dsn != nil {
+		pi.SetReadTimeout(dsn.ReadTimeout)
+		pi.SetWriteTimeout(dsn.WriteTimeout)
+		pi.MaxResultRows = dsn.MaxResultRows
+	}
 	pi.ServerConf = make(map[string]string)
 	pi.IOError = nil
 	return pi
 }
 
 type PgIO struct {
+	// 读、写超时，以 time.Duration 的值原子读写。放在最前以保证 32 位平台上的 64 位对齐
+	readTimeout  int64
+	writeTimeout int64
+
 	dsn        *helper.DataSourceName
 	tlsConfig  tls.Config
 	conn       net.Conn
 	reader     *bufio.Reader
+	writer     *bufio.Writer
 	txStatus   TransactionStatus
 	serverPid  uint32
 	ServerConf map[string]string
 	backendKey uint32
 	Location   *time.Location
 	IOError    error
+	// 启动时收到了 BackendKeyData。部分连接池会去掉该消息，此时无法发送 CancelRequest
+	backendKeyReceived bool
+	// 由 ParameterStatus 中的 server_version 解析出的 major、minor、patch
+	serverVersion [3]int
+	// NoticeResponse 的处理函数，通过 SetNoticeHandler 设置
+	noticeMu      sync.Mutex
+	noticeHandler func(*PgError)
+	// NotificationHandler 在 ReceiveAsync 读到查询之间到达的 NotificationResponse 时被调用
+	NotificationHandler func(*Notification)
+	// ParameterStatusHandler 在收到 ParameterStatus 时被调用，包括会话中途 SET 引起的变更
+	ParameterStatusHandler func(key, value string)
+	// MaxResultRows 驱动查询时每次从服务端获取的最大行数，为 0 时一次获取全部，见 ParseQueryFetchContext
+	MaxResultRows int
+	// CloseParseAsync 暂存、尚未发送的 Close
+	pendingCloses []*PgMessage
+	// 已发送扩展查询的消息但尚未发送 Sync，此时不能插入暂存的 Close
+	inExtended bool
+	// ParseQueryFetchContext 挂起的门户尚未结束，此时只能继续获取或关闭该门户
+	portalSuspended bool
+	// 门户挂起期间开始新请求时先调用，见 SetPortalDrain
+	drainPortal func() error
+	// 由 ctx 得到的读写截止时间，见 setDeadline。read_timeout 等只在其之前生效，用完后恢复为它
+	deadline time.Time
+	// WriteTimeout 每次写出消息的超时时间，为 0 时不限制。超时后连接作废
+	//
+	// Deprecated: 并发修改不安全，请使用 SetWriteTimeout；两者都设置时以 SetWriteTimeout 为准
+	WriteTimeout time.Duration
+}
+
+// BackendPID 返回服务端进程ID，来自 BackendKeyData
+func (pi *PgIO) BackendPID() uint32 {
+	return pi.serverPid
 }
 
+// BackendSecretKey 返回 CancelRequest 所需的密钥，来自 BackendKeyData。
+// 该值属于敏感信息，持有者可取消此连接上的查询，不要记录到日志中。
+func (pi *PgIO) BackendSecretKey() uint32 {
+	return pi.backendKey
+}
+
+// Md5 返回 s 的 MD5 十六进制摘要。
+//
+// Deprecated: 与网络读写无关，将在下一个次版本中移除；需要时直接使用 crypto/md5。
 func (pi *PgIO) Md5(s string) string {
-	h := md5.New()
-	h.Write([]byte(s))
-	return fmt.Sprintf("%x", h.Sum(nil))
+	var sum = md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
 }
 
-func (pi *PgIO) receivePgMsg(sep Identifies) (ms []PgMessage, err error) {
-	for {
-		var msg PgMessage
-		id, err := pi.reader.ReadByte()
-		if err != nil {
-			pi.IOError = err
-			return ms, err
-		}
-		msg.Identifies = Identifies(id)
-		msg.Content, err = pi.reader.Peek(4)
-		if err != nil {
-			return ms, err
-		}
-		msg.Len = binary.BigEndian.Uint32(msg.Content)
-		msg.Content = make([]byte, msg.Len, msg.Len)
-		_, err = io.ReadFull(pi.reader, msg.Content)
-		if err != nil {
-			return ms, err
-		}
-		msg.Position = 4
-		ms = append(ms, msg)
-		if msg.Identifies == sep {
-			return ms, nil
-		}
-	}
+// md5Salted 计算 MD5 认证的口令摘要 md5(md5(password + user) + salt)，不含 "md5" 前缀。
+// 复用同一个 hash 并在栈上完成十六进制编码，避免中间字符串的分配
+func md5Salted(password, user string, salt []byte) string {
+	var sum [md5.Size]byte
+	var inner [md5.Size * 2]byte
+	h := md5.New()
+	_, _ = io.WriteString(h, password)
+	_, _ = io.WriteString(h, user)
+	hex.Encode(inner[:], h.Sum(sum[:0]))
+	h.Reset()
+	_, _ = h.Write(inner[:])
+	_, _ = h.Write(salt)
+	hex.Encode(inner[:], h.Sum(sum[:0]))
+	return string(inner[:])
 }
 
-func (pi *PgIO) receivePgMsgOnce() (msg PgMessage, err error) {
+// maxMessageLen 服务端单条消息的长度上限，与服务端单个值的上限（1GB）相当。
+// 长度超出时说明数据流已错位，不按其分配内存
+const maxMessageLen = 1<<30 + 1<<20
+
+// readMsg 读取一条完整的消息，ParameterStatus、NoticeResponse 同时交给对应的处理函数
+func (pi *PgIO) readMsg() (msg PgMessage, err error) {
 	id, err := pi.reader.ReadByte()
 	if err != nil {
 		pi.IOError = err
 		return msg, err
 	}
+	if !validateIdentifies(id) {
+		pi.IOError = ErrProtocolViolation
+		return msg, ErrProtocolViolation
+	}
 	msg.Identifies = Identifies(id)
 	msg.Content, err = pi.reader.Peek(4)
 	if err != nil {
 		return msg, err
 	}
 	msg.Len = binary.BigEndian.Uint32(msg.Content)
+	if msg.Len < 4 || msg.Len > maxMessageLen {
+		pi.IOError = ErrMalformedMessage
+		return msg, ErrMalformedMessage
+	}
 	msg.Content = make([]byte, msg.Len, msg.Len)
 	_, err = io.ReadFull(pi.reader, msg.Content)
 	if err != nil {
 		return msg, err
 	}
 	msg.Position = 4
+	if msg.Identifies == IdentifiesParameterStatus {
+		pi.parameterStatus(msg)
+	} else if msg.Identifies == IdentifiesNoticeResponse {
+		pi.notice(msg)
+	}
+	return
+}
+
+func (pi *PgIO) receivePgMsg(sep Identifies) (ms []PgMessage, err error) {
+	defer pi.applyReadTimeout()()
+	// 最常见的应答是 CommandComplete + ReadyForQuery，预留两条的容量，省去追加时的扩容
+	ms = make([]PgMessage, 0, 2)
+	for {
+		msg, err := pi.readMsg()
+		if err != nil {
+			return ms, err
+		}
+		ms = append(ms, msg)
+		if msg.Identifies == sep {
+			return ms, nil
+		}
+	}
+}
+
+func (pi *PgIO) receivePgMsgOnce() (msg PgMessage, err error) {
+	defer pi.applyReadTimeout()()
+	if msg, err = pi.readMsg(); err != nil {
+		return
+	}
 	if msg.Identifies == IdentifiesErrorResponse {
 		return msg, msg.ParseError()
 	}
 	return
 }
 
+// msg 为值拷贝，读取不影响调用方的 Position
+func (pi *PgIO) parameterStatus(msg PgMessage) {
+	k := msg.string()
+	v := msg.string()
+	if k == "TimeZone" {
+		var err error
+		pi.Location, err = time.LoadLocation(v)
+		if err != nil {
+			pi.Location = nil
+		}
+	}
+	if k == "server_version" {
+		pi.serverVersion = parseServerVersion(v)
+	}
+	pi.ServerConf[k] = v
+	if pi.ParameterStatusHandler != nil {
+		pi.ParameterStatusHandler(k, v)
+	}
+}
+
+// SetNoticeHandler 设置 NoticeResponse 的处理函数，为 nil 时丢弃。可在查询执行期间从其他 goroutine 调用
+func (pi *PgIO) SetNoticeHandler(fn func(*PgError)) {
+	pi.noticeMu.Lock()
+	pi.noticeHandler = fn
+	pi.noticeMu.Unlock()
+}
+
+// msg 为值拷贝，读取不影响调用方的 Position
+func (pi *PgIO) notice(msg PgMessage) {
+	pi.noticeMu.Lock()
+	var fn = pi.noticeHandler
+	pi.noticeMu.Unlock()
+	if fn != nil {
+		fn(msg.ParseError())
+	}
+}
+
+// setDeadline 设置并记录连接的读写截止时间，t 为零值时取消。
+// 需要按 ctx 限制阻塞读写的调用都应经由它设置，read_timeout、write_timeout 不会越过或清除它
+func (pi *PgIO) setDeadline(t time.Time) error {
+	pi.deadline = t
+	return pi.conn.SetDeadline(t)
+}
+
+// applyReadTimeout 以 read_timeout 设置本次读取的截止时间，不晚于 setDeadline 设置的时间。
+// 返回的函数恢复原截止时间；未设置 read_timeout 时什么都不做
+func (pi *PgIO) applyReadTimeout() (restore func()) {
+	d := time.Duration(atomic.LoadInt64(&pi.readTimeout))
+	if d <= 0 {
+		return func() {}
+	}
+	_ = pi.conn.SetReadDeadline(earlier(time.Now().Add(d), pi.deadline))
+	return func() {
+		_ = pi.conn.SetReadDeadline(pi.deadline)
+	}
+}
+
+// earlier 返回较早的截止时间，零值表示不限制
+func earlier(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// SetReadTimeout 设置读取一次完整响应的超时时间，为 0 时不限制，超时后连接作废。
+// 可在其他 goroutine 中调用。为个别耗时的查询放宽超时后，由调用方负责恢复原值
+func (pi *PgIO) SetReadTimeout(d time.Duration) {
+	atomic.StoreInt64(&pi.readTimeout, int64(d))
+}
+
+// SetWriteTimeout 设置每次写出消息的超时时间，为 0 时不限制，超时后连接作废。
+// 可在其他 goroutine 中调用。为大批量写入放宽超时后，由调用方负责恢复原值
+func (pi *PgIO) SetWriteTimeout(d time.Duration) {
+	atomic.StoreInt64(&pi.writeTimeout, int64(d))
+}
+
+// send 先写入缓冲区，遇到需要服务端立即处理的消息（如 Sync、Flush）时才真正写出。
+// 开始一次新请求时先发送 CloseParseAsync 暂存的 Close，见 sendPendingCloses
 func (pi *PgIO) send(list ...*PgMessage) (err error) {
-	var raw []byte
-	for _, v := range list {
-		raw = append(raw, v.encode()...)
+	if pi.portalSuspended && len(list) > 0 && startsRequest(list[0].Identifies) {
+		if pi.drainPortal == nil {
+			return ErrPortalSuspended
+		}
+		var drain = pi.drainPortal
+		pi.drainPortal = nil
+		if err = drain(); err != nil {
+			return
+		}
+		if pi.portalSuspended {
+			return ErrPortalSuspended
+		}
+	}
+	if len(pi.pendingCloses) > 0 && !pi.inExtended && len(list) > 0 && startsRequest(list[0].Identifies) {
+		return pi.sendPendingCloses(list...)
 	}
-	_, pi.IOError = pi.conn.Write(raw)
-	return pi.IOError
+	return pi.write(list...)
 }
 
-func (pi *PgIO) Dial(network, address string, timeout time.Duration) (err error) {
-	pi.conn, err = net.DialTimeout(network, address, timeout)
-	if err == nil {
-		pi.reader = bufio.NewReader(pi.conn)
+// startsRequest 判断消息能否作为一次新请求的开头。复制数据、Terminate、Sync 等不能
+func startsRequest(id Identifies) bool {
+	switch id {
+	case IdentifiesParse, IdentifiesBind, IdentifiesDescribe, IdentifiesExecute, IdentifiesClose,
+		IdentifiesQuery, IdentifiesFunctionCall:
+		return true
+	}
+	return false
+}
+
+// write 写出 list，并记录扩展查询是否已以 Sync 结束
+func (pi *PgIO) write(list ...*PgMessage) (err error) {
+	var d = time.Duration(atomic.LoadInt64(&pi.writeTimeout))
+	if d <= 0 {
+		d = pi.WriteTimeout
+	}
+	if d > 0 {
+		if err = pi.conn.SetWriteDeadline(earlier(time.Now().Add(d), pi.deadline)); err != nil {
+			pi.IOError = err
+			return
+		}
+		defer func() {
+			if err == nil {
+				_ = pi.conn.SetWriteDeadline(pi.deadline)
+			}
+		}()
+	}
+	// 消息有误时什么都不发送，连接仍然可用
+	for _, v := range list {
+		if v.err != nil {
+			return v.err
+		}
+	}
+	var flush bool
+	for _, v := range list {
+		if _, err = pi.writer.Write(v.encode()); err != nil {
+			pi.writeFailed(err)
+			return
+		}
+		flush = flush || v.isFlushPoint()
+		switch v.Identifies {
+		case IdentifiesSync:
+			pi.inExtended, pi.portalSuspended, pi.drainPortal = false, false, nil
+		case IdentifiesParse, IdentifiesBind, IdentifiesDescribe, IdentifiesExecute, IdentifiesClose:
+			pi.inExtended = true
+		}
+	}
+	if flush {
+		if err = pi.writer.Flush(); err != nil {
+			pi.writeFailed(err)
+		}
 	}
 	return
 }
 
-func (pi *PgIO) DialContext(context context.Context, network, address string, timeout time.Duration) (err error) {
-	d := net.Dialer{Timeout: timeout}
-	pi.conn, err = d.DialContext(context, network, address)
-	if err == nil {
-		pi.reader = bufio.NewReader(pi.conn)
+// writeFailed 标记连接不可用。写超时说明服务端可能仍在处理之前的查询而未读取，
+// 通过新连接发送 CancelRequest 终止服务端的工作
+func (pi *PgIO) writeFailed(err error) {
+	pi.IOError = err
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		pi.IOError = driver.ErrBadConn
+		_ = pi.CancelRequest()
+	}
+}
+
+// SendFlush 发送 Flush 消息，要求服务端返回已产生的响应，但不结束当前的扩展查询
+func (pi *PgIO) SendFlush() error {
+	return pi.send(NewPgMessage(IdentifiesFlush))
+}
+
+// Sync 发送 Sync 并读取到 ReadyForQuery，结束当前的扩展查询流水线。
+// 返回期间收到的第一个 ErrorResponse；不在事务中时，服务端在此提交或回滚隐式事务
+func (pi *PgIO) Sync() (err error) {
+	if err = pi.send(NewPgMessage(IdentifiesSync)); err != nil {
+		return
 	}
+	_, err = pi.ReadyForQueryStatus(context.Background())
 	return
 }
 
+// ReadyForQueryStatus 读取消息直到 ReadyForQuery，返回其中的事务状态。
+// 期间的 NoticeResponse、ParameterStatus 交给对应的处理函数，其余消息被丢弃；
+// 返回第一个 ErrorResponse，但仍读到 ReadyForQuery 为止。ctx 只在消息之间生效，
+// ctx 结束时 ReadyForQuery 仍未读到，连接作废
+func (pi *PgIO) ReadyForQueryStatus(ctx context.Context) (status TransactionStatus, err error) {
+	for {
+		if e := pi.waitReadable(ctx); e != nil {
+			if pi.IOError == nil {
+				pi.IOError = e
+			}
+			return pi.txStatus, e
+		}
+		msg, e := pi.receivePgMsgOnce()
+		switch {
+		case msg.Identifies == IdentifiesErrorResponse:
+			if err == nil {
+				err = e
+			}
+		case e != nil:
+			return pi.txStatus, e
+		case msg.Identifies == IdentifiesReadyForQuery:
+			pi.txStatus = TransactionStatus(msg.byte())
+			if msg.overrun && err == nil {
+				err = ErrMalformedMessage
+			}
+			return pi.txStatus, err
+		}
+	}
+}
+
+func (pi *PgIO) setConn(conn net.Conn) {
+	pi.conn = conn
+	pi.reader = bufio.NewReader(conn)
+	pi.writer = bufio.NewWriter(conn)
+}
+
+func (pi *PgIO) Dial(network, address string, timeout time.Duration) (err error) {
+	return pi.DialContext(context.Background(), network, address, timeout)
+}
+
+// DialDSN 按数据源中的地址及 connect_timeout 建立连接
+func (pi *PgIO) DialDSN() error {
+	return pi.Dial(pi.dsn.Address())
+}
+
+// DialUnix 通过 Unix 域套接字连接本机服务端，socketPath 为完整的套接字文件路径，如 /tmp/.s.PGSQL.5432
+func (pi *PgIO) DialUnix(socketPath string, timeout time.Duration) error {
+	return pi.Dial("unix", socketPath, timeout)
+}
+
+// DialContext 建立连接。遇到网络错误（域名解析失败、连接被拒绝等）时按 dsn 中的
+// ConnectRetries 及 ConnectRetryInterval 退避重试，便于容器启动时等待数据库就绪；
+// timeout 限制包括重试在内的总时长，为 0 时使用数据源的 connect_timeout
+func (pi *PgIO) DialContext(ctx context.Context, network, address string, timeout time.Duration) (err error) {
+	if timeout <= 0 && pi.dsn != nil {
+		timeout = pi.dsn.EffectiveConnectTimeout()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var retries int
+	var interval time.Duration
+	if pi.dsn != nil {
+		retries, interval = pi.dsn.ConnectRetries, pi.dsn.ConnectRetryInterval
+	}
+	for i := 0; ; i++ {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+		if err == nil {
+			pi.setConn(conn)
+			return nil
+		}
+		if i >= retries || ctx.Err() != nil || !isRetryableDialError(err) {
+			return err
+		}
+		var timer = time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		interval *= 2
+	}
+}
+
+// 拨号阶段的网络错误可以重试，超时不重试
+func isRetryableDialError(err error) bool {
+	ne, ok := err.(*net.OpError)
+	return ok && ne.Op == "dial" && !ne.Timeout()
+}
+
+func (pi *PgIO) redial() (err error) {
+	if pi.conn != nil {
+		_ = pi.conn.Close()
+	}
+	pi.tlsConfig = tls.Config{}
+	pi.IOError = nil
+	return pi.DialDSN()
+}
+
 func (pi *PgIO) StartUp() (err error) {
-	if pi.dsn.SSL.Mode != "disable" && pi.dsn.SSL.Mode != "allow" {
+	return pi.StartUpContext(context.Background())
+}
+
+// StartUpContext 完成SSL协商、认证及会话启动。整个过程受数据源的 connect_timeout 限制，
+// ctx 到期或取消时中止，避免认证服务（如 LDAP、Kerberos）无响应时永久阻塞
+func (pi *PgIO) StartUpContext(ctx context.Context) (err error) {
+	if err = pi.startUpWith(ctx, pi.dsn.Parameter); err != nil {
+		return
+	}
+	return pi.verifySession()
+}
+
+// verifySession 按 require_database、require_user 确认服务端连接的数据库及用户与数据源一致，
+// 防止 pg_hba.conf 等配置复杂时连到了意外的数据库
+func (pi *PgIO) verifySession() error {
+	if !pi.dsn.RequireDatabase && !pi.dsn.RequireUser {
+		return nil
+	}
+	_, _, data, err := pi.QueryNoArgs("select current_database(), current_user")
+	if err != nil {
+		return err
+	}
+	if len(*data) != 1 || len((*data)[0]) != 2 {
+		return ErrMalformedMessage
+	}
+	var user = pi.dsn.Parameter["user"]
+	var database = pi.dsn.Parameter["database"]
+	if database == "" {
+		// 未指定数据库时服务端使用与用户同名的数据库
+		database = user
+	}
+	if pi.dsn.RequireDatabase && string((*data)[0][0]) != database {
+		return ErrWrongDatabase
+	}
+	if pi.dsn.RequireUser && string((*data)[0][1]) != user {
+		return ErrWrongUser
+	}
+	return nil
+}
+
+// StartupReplication 以复制协议启动会话：mode 为 database 时用于逻辑复制，为 true 时用于物理流复制，
+// 为 false 时与 StartUp 相同。复制连接只发送用户、数据库、应用名及客户端编码，不设置 TimeZone 等会话参数
+func (pi *PgIO) StartupReplication(mode string) (err error) {
+	switch mode {
+	case "false":
+		return pi.StartUp()
+	case "database", "true":
+	default:
+		return fmt.Errorf("pg: invalid replication mode %q", mode)
+	}
+	var params = map[string]string{"replication": mode}
+	for _, k := range []string{"user", "database", "application_name", "client_encoding"} {
+		if v, has := pi.dsn.Parameter[k]; has {
+			params[k] = v
+		}
+	}
+	if mode == "true" {
+		// 物理复制连接的是整个集群，不属于某个数据库
+		delete(params, "database")
+	}
+	return pi.startUpWith(context.Background(), params)
+}
+
+func (pi *PgIO) startUpWith(ctx context.Context, params map[string]string) (err error) {
+	if timeout := pi.dsn.EffectiveConnectTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	defer func() {
+		if err != nil {
+			// 读写超时与 ctx 到期几乎同时发生，超时先返回时 ctx.Err() 可能仍为 nil
+			if ctx.Err() != nil {
+				pi.IOError = err
+				err = ctx.Err()
+			} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				pi.IOError = err
+				err = context.DeadlineExceeded
+			}
+		}
+		if pi.conn != nil {
+			_ = pi.setDeadline(time.Time{})
+		}
+	}()
+	pi.startUpDeadline(ctx)
+
+	if pi.dsn.SSL.Mode != helper.SSLModeDisable && pi.dsn.SSL.Mode != helper.SSLModeAllow {
 		err = pi.ssl()
+		if err != nil && pi.dsn.SSL.Mode == helper.SSLModePrefer {
+			// prefer：服务端已同意SSL但握手失败，连接已不可用，重新建立明文连接
+			if err = pi.redial(); err == nil {
+				pi.startUpDeadline(ctx)
+			}
+		}
 		if err != nil {
 			return
 		}
 	}
 
+	err = pi.startUp(ctx, params)
+	if err != nil && pi.dsn.SSL.Mode == helper.SSLModeAllow && isSSLRequiredError(err) {
+		// allow：服务端拒绝明文连接（如 pg_hba.conf 中只有 hostssl），与 libpq 一致改用SSL重新连接
+		if err = pi.redial(); err != nil {
+			return
+		}
+		pi.startUpDeadline(ctx)
+		if err = pi.ssl(); err != nil {
+			return
+		}
+		err = pi.startUp(ctx, params)
+	}
+	return
+}
+
+// startUpDeadline 阻塞中的读写无法检查 ctx，以 ctx 的截止时间作为连接的读写超时
+func (pi *PgIO) startUpDeadline(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = pi.setDeadline(deadline)
+	}
+}
+
+// 服务端因连接未加密而拒绝登录时返回 28000 invalid_authorization_specification
+func isSSLRequiredError(err error) bool {
+	e, ok := err.(*PgError)
+	return ok && e.SQLState == "28000"
+}
+
+// startUp 发送 StartupMessage 并完成认证，直到收到 ReadyForQuery
+func (pi *PgIO) startUp(ctx context.Context, params map[string]string) (err error) {
 	bs := NewPgMessage(IdentifiesStartupMessage)
 	bs.addInt32(196608)
-	for k, v := range pi.dsn.Parameter {
+	for k, v := range params {
 		bs.addString(k)
 		bs.addString(v)
 	}
 	bs.addByte(0)
+	if bs.err != nil {
+		return bs.err
+	}
 	_ = bs.encode()
+	pi.backendKeyReceived = false
 	_, err = pi.conn.Write(bs.Content)
 	if err != nil {
 		return
 	}
 
 	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		m, err := pi.receivePgMsgOnce()
 		if err != nil {
 			return err
@@ -158,27 +627,38 @@ func (pi *PgIO) StartUp() (err error) {
 			if err != nil {
 				return err
 			}
-		case IdentifiesParameterStatus:
-			k := m.string()
-			v := m.string()
-			if k == "TimeZone" {
-				pi.Location, err = time.LoadLocation(v)
-				if err != nil {
-					err = nil
-					pi.Location = nil
-				}
-			}
-			pi.ServerConf[k] = v
 		case IdentifiesBackendKeyData:
 			pi.serverPid = m.int32()
 			pi.backendKey = m.int32()
+			if m.overrun {
+				return ErrMalformedMessage
+			}
+			pi.backendKeyReceived = true
 		case IdentifiesReadyForQuery:
 			pi.txStatus = TransactionStatus(m.byte())
-			return nil
+			return pi.checkClientEncoding()
 		}
 	}
 }
 
+// checkClientEncoding 确认服务端接受了数据源中指定的 client_encoding。
+// 驱动不做转码，文本按原样以 []byte 处理，推荐始终使用 UTF8
+func (pi *PgIO) checkClientEncoding() error {
+	var want = normalizeEncoding(pi.dsn.Parameter["client_encoding"])
+	if want == "" || want == "UTF8" {
+		return nil
+	}
+	if got := pi.ServerConf["client_encoding"]; normalizeEncoding(got) != want {
+		return fmt.Errorf("pg: server did not accept client_encoding %q, got %q", pi.dsn.Parameter["client_encoding"], got)
+	}
+	return nil
+}
+
+// 编码名不区分大小写，且服务端忽略其中的 - 及 _，如 utf-8、Latin_1
+func normalizeEncoding(name string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", "_", "").Replace(name))
+}
+
 func (pi *PgIO) auth(msg PgMessage) (err error) {
 	switch code := msg.int32(); code {
 	case 0:
@@ -205,7 +685,7 @@ func (pi *PgIO) auth(msg PgMessage) (err error) {
 	case 5:
 		// MD5密码
 		reqPwd := NewPgMessage(IdentifiesPasswordMessage)
-		reqPwd.addString("md5" + pi.Md5(pi.Md5(pi.dsn.Password+pi.dsn.Parameter["user"])+string(msg.bytes(4))))
+		reqPwd.addString("md5" + md5Salted(pi.dsn.Password, pi.dsn.Parameter["user"], msg.bytes(4)))
 
 		err = pi.send(reqPwd)
 		if err != nil {
@@ -220,11 +700,37 @@ func (pi *PgIO) auth(msg PgMessage) (err error) {
 				return fmt.Errorf("unexpected authentication response: %q", v.Identifies)
 			}
 		}
+	case 2:
+		return errUnsupportedAuth(code, "KerberosV5")
+	case 6:
+		return errUnsupportedAuth(code, "SCM credential")
+	case 7:
+		return pi.authGSS()
+	case 9:
+		return errUnsupportedAuth(code, "SSPI")
+	case 10:
+		return pi.authSASL(msg)
+	default:
+		return errUnsupportedAuth(code, "")
 	}
 	return
 }
 
+func errUnsupportedAuth(code uint32, method string) error {
+	if method != "" {
+		return fmt.Errorf("unsupported authentication method %v: code %d, request support at https://github.com/blusewang/pg/issues", method, code)
+	}
+	return fmt.Errorf("unsupported authentication method: code %d, request support at https://github.com/blusewang/pg/issues", code)
+}
+
 func (pi *PgIO) QueryNoArgs(query string) (cols []PgColumn, fieldLen *[][]uint32, data *[][][]byte, err error) {
+	// 空查询服务端只会返回 EmptyQueryResponse，不必发送
+	if strings.TrimSpace(query) == "" {
+		return nil, new([][]uint32), new([][][]byte), nil
+	}
+	if err = pi.ReceiveAsync(); err != nil {
+		return
+	}
 	sq := NewPgMessage(IdentifiesQuery)
 	sq.addString(query)
 	err = pi.send(sq)
@@ -242,49 +748,59 @@ func (pi *PgIO) QueryNoArgs(query string) (cols []PgColumn, fieldLen *[][]uint32
 	for _, v := range list {
 		switch v.Identifies {
 		case IdentifiesErrorResponse:
+			// 出错前已收到的行不完整，丢弃
 			err = v.ParseError()
+			*fieldLen, *data = (*fieldLen)[:0], (*data)[:0]
 		case IdentifiesDataRow:
-			var rowLen = new([]uint32)
-			var row = new([][]byte)
-			length := v.int16()
-			for i := uint16(0); i < length; i++ {
-				l := v.int32()
-				if l == 4294967295 {
-					// nil
-					*row = append(*row, nil)
-				} else {
-					*row = append(*row, v.bytes(l))
-				}
-				*rowLen = append(*rowLen, l)
+			if err != nil {
+				break
 			}
-			*fieldLen = append(*fieldLen, *rowLen)
-			*data = append(*data, *row)
+			rowLen, row := v.dataRow()
+			*fieldLen = append(*fieldLen, rowLen)
+			*data = append(*data, row)
 		case IdentifiesRowDescription:
 			cols = v.columns()
+		case IdentifiesEmptyQueryResponse:
+			// 空查询，没有 CommandComplete
 		case IdentifiesReadyForQuery:
 			pi.txStatus = TransactionStatus(v.byte())
 		}
+		if v.overrun && err == nil {
+			err = ErrMalformedMessage
+		}
 	}
 	return
 }
 
-func (pi *PgIO) Parse(name, query string) (cols []PgColumn, parameters []uint32, err error) {
-	reqParse := NewPgMessage(IdentifiesParse)
-	reqParse.addString(name)
-	reqParse.addString(query)
-	reqParse.addInt16(0) // 参数数量统一置0
+// QueryNoArgsExec 执行不返回行的简单查询（DDL、DML），返回 CommandComplete 的原始标签及影响行数
+func (pi *PgIO) QueryNoArgsExec(query string) (tag string, n int64, err error) {
+	err = pi.queryNoArgsExec(query, func(t string) {
+		tag = t
+		_, _, n, _ = helper.ParseCommandComplete(tag)
+	})
+	return
+}
 
-	reqDes := NewPgMessage(IdentifiesDescribe)
-	reqDes.addByte('S')
-	reqDes.addString(name)
+// QueryNoArgsMultiExec 执行可能包含多条语句的简单查询，返回所有语句影响行数之和。
+// 只适用于不返回行的语句；包含查询语句时请使用 QueryNoArgsMulti
+func (pi *PgIO) QueryNoArgsMultiExec(query string) (totalAffected int64, err error) {
+	err = pi.queryNoArgsExec(query, func(tag string) {
+		_, _, n, _ := helper.ParseCommandComplete(tag)
+		totalAffected += n
+	})
+	return
+}
 
-	err = pi.send(reqParse, reqDes, NewPgMessage(IdentifiesSync))
+// queryNoArgsExec 执行简单查询并读取到 ReadyForQuery，依次以每个 CommandComplete 的标签调用 complete
+func (pi *PgIO) queryNoArgsExec(query string, complete func(tag string)) (err error) {
+	sq := NewPgMessage(IdentifiesQuery)
+	sq.addString(query)
+	err = pi.send(sq)
 	if err != nil {
 		return
 	}
 
 	list, err := pi.receivePgMsg(IdentifiesReadyForQuery)
-
 	if err != nil {
 		return
 	}
@@ -292,67 +808,300 @@ func (pi *PgIO) Parse(name, query string) (cols []PgColumn, parameters []uint32,
 		switch v.Identifies {
 		case IdentifiesErrorResponse:
 			err = v.ParseError()
-		case IdentifiesParameterDescription:
-			var pn = v.int16()
-			for i := uint16(0); i < pn; i++ {
-				parameters = append(parameters, v.int32())
-			}
-		case IdentifiesRowDescription:
-			cols = v.columns()
+		case IdentifiesCommandComplete:
+			complete(v.string())
 		case IdentifiesReadyForQuery:
 			pi.txStatus = TransactionStatus(v.byte())
 		}
+		if v.overrun && err == nil {
+			err = ErrMalformedMessage
+		}
 	}
 	return
 }
 
-func (pi *PgIO) ParseExec(name string, args []interface{}) (n int, err error) {
-	rBind := NewPgMessage(IdentifiesBind)
-	rBind.addString("")
-	rBind.addString(name)
-	rBind.addInt16(0)
-	rBind.addInt16(len(args))
-	for _, arg := range args {
-		if arg == nil {
-			rBind.addInt32(-1)
-		} else {
-			b := value2bytes(arg)
-			rBind.addInt32(len(b))
-			rBind.addBytes(b)
-		}
-	}
-	rBind.addInt16(0)
-	rExec := NewPgMessage(IdentifiesExecute)
-	rExec.addString("")
-	rExec.addInt32(0) // all rows
-	err = pi.send(rBind, rExec, NewPgMessage(IdentifiesSync))
+// SendQueryStream 执行简单查询，每收到一行即交给 fn 处理，不在内存中保留结果集。
+// ctx 结束或 fn 返回错误时发送 CancelRequest，并读完剩余消息直到 ReadyForQuery。
+// 取消请求发出后连接被标记为不可用，原因见 WatchCancel
+func (pi *PgIO) SendQueryStream(ctx context.Context, query string, fn func(cols []PgColumn, row [][]byte) error) (err error) {
+	sq := NewPgMessage(IdentifiesQuery)
+	sq.addString(query)
+	err = pi.send(sq)
 	if err != nil {
 		return
 	}
-	list, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	// 服务端迟迟不返回消息时，由 WatchCancel 负责取消
+	defer pi.WatchCancel(ctx)()
+
+	var cols []PgColumn
+	var cancelled, sent bool
+	var cancel = func() {
+		if !cancelled {
+			cancelled = true
+			sent = pi.CancelRequest() == nil
+		}
+	}
+	for {
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+			cancel()
+		}
+		msg, e := pi.receivePgMsgOnce()
+		if msg.Identifies == IdentifiesErrorResponse {
+			if err == nil {
+				err = e
+			}
+			continue
+		} else if e != nil {
+			return e
+		}
+		switch msg.Identifies {
+		case IdentifiesRowDescription:
+			cols = msg.columns()
+		case IdentifiesDataRow:
+			if err != nil {
+				break
+			}
+			_, row := msg.dataRow()
+			if msg.overrun {
+				err = ErrMalformedMessage
+			} else {
+				err = fn(cols, row)
+			}
+			if err != nil {
+				cancel()
+			}
+		case IdentifiesReadyForQuery:
+			pi.txStatus = TransactionStatus(msg.byte())
+			if sent && pi.IOError == nil {
+				pi.IOError = ErrCancelPending
+			}
+			return
+		}
+	}
+}
+
+// QueryNoArgsMulti 执行可能包含多条语句的简单查询，每条返回行的语句对应一个结果集
+func (pi *PgIO) QueryNoArgsMulti(query string) (sets []ResultSet, err error) {
+	sq := NewPgMessage(IdentifiesQuery)
+	sq.addString(query)
+	err = pi.send(sq)
 	if err != nil {
 		return
 	}
+
+	list, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	if err != nil {
+		return
+	}
+	var current *ResultSet
 	for _, v := range list {
 		switch v.Identifies {
 		case IdentifiesErrorResponse:
+			// 出错的语句没有完整的结果集，丢弃
 			err = v.ParseError()
+			current = nil
+		case IdentifiesRowDescription:
+			current = &ResultSet{Columns: v.columns(), FieldLen: new([][]uint32), Rows: new([][][]byte)}
+		case IdentifiesDataRow:
+			if current == nil {
+				continue
+			}
+			rowLen, row := v.dataRow()
+			*current.FieldLen = append(*current.FieldLen, rowLen)
+			*current.Rows = append(*current.Rows, row)
 		case IdentifiesCommandComplete:
-			var rs = strings.Split(v.string(), " ")
-			if len(rs) == 2 {
-				n, _ = strconv.Atoi(rs[1])
+			if current != nil {
+				sets = append(sets, *current)
+				current = nil
 			}
 		case IdentifiesReadyForQuery:
 			pi.txStatus = TransactionStatus(v.byte())
 		}
+		if v.overrun && err == nil {
+			err = ErrMalformedMessage
+		}
+	}
+	if len(sets) == 0 {
+		sets = append(sets, ResultSet{FieldLen: new([][]uint32), Rows: new([][][]byte)})
 	}
 	return
 }
 
-// data 使用指针减少copy时的内存损耗
-func (pi *PgIO) ParseQuery(name string, args []interface{}) (fieldLen *[][]uint32, data *[][][]byte, err error) {
+func (pi *PgIO) Parse(name, query string) (cols []PgColumn, parameters []uint32, err error) {
+	// 空语句不发送，也就不会在服务端预备，执行方应同样跳过
+	if strings.TrimSpace(query) == "" {
+		return
+	}
+	reqParse := NewPgMessage(IdentifiesParse)
+	reqParse.addString(name)
+	reqParse.addString(query)
+	reqParse.addInt16(0) // 参数数量统一置0
+
+	reqDes := NewPgMessage(IdentifiesDescribe)
+	reqDes.addByte('S')
+	reqDes.addString(name)
+
+	for retried := false; ; retried = true {
+		err = pi.send(reqParse, reqDes, NewPgMessage(IdentifiesSync))
+		if err != nil {
+			return
+		}
+		cols, parameters, err = pi.receiveDescription()
+		// 42P05 同名语句已存在（如重连后经连接池分到了同一后端），关闭后重新预备，只重试一次。
+		// 事务中出错时事务已失败，无法重试
+		if e, ok := err.(*PgError); !ok || e.SQLState != "42P05" || retried || pi.txStatus == TransactionStatusInFailedTransaction {
+			return
+		}
+		if err = pi.CloseParse(name); err != nil {
+			return
+		}
+	}
+}
+
+// Describe 描述服务端已存在的预备语句，不重新 Parse，如会话中以 PREPARE 创建的语句。
+// 语句不存在时返回 ErrStatementNotFound
+func (pi *PgIO) Describe(name string) (cols []PgColumn, parameters []uint32, err error) {
+	reqDes := NewPgMessage(IdentifiesDescribe)
+	reqDes.addByte('S')
+	reqDes.addString(name)
+
+	err = pi.send(reqDes, NewPgMessage(IdentifiesSync))
+	if err != nil {
+		return
+	}
+	cols, parameters, err = pi.receiveDescription()
+	if e, ok := err.(*PgError); ok && e.SQLState == "26000" {
+		err = ErrStatementNotFound
+	}
+	return
+}
+
+// receiveDescription 读取 Describe('S') 的 ParameterDescription 及 RowDescription，直到 ReadyForQuery
+func (pi *PgIO) receiveDescription() (cols []PgColumn, parameters []uint32, err error) {
+	list, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	if err != nil {
+		return
+	}
+	for _, v := range list {
+		switch v.Identifies {
+		case IdentifiesErrorResponse:
+			err = v.ParseError()
+		case IdentifiesParameterDescription:
+			var pn = v.int16()
+			for i := uint16(0); i < pn; i++ {
+				parameters = append(parameters, v.int32())
+			}
+		case IdentifiesRowDescription:
+			cols = v.columns()
+		case IdentifiesReadyForQuery:
+			pi.txStatus = TransactionStatus(v.byte())
+		}
+		if v.overrun && err == nil {
+			err = ErrMalformedMessage
+		}
+	}
+	return
+}
+
+// ParseBatch 在一次往返中预备多条语句。每条语句的 Parse、Describe 之后各跟一个 Sync，
+// 使一条语句出错时服务端不会跳过其余语句；错误记录在对应下标的 BatchResult.Err 中。
+// 返回的 err 只表示网络错误
+func (pi *PgIO) ParseBatch(entries []BatchEntry) (results []BatchResult, err error) {
+	var list []*PgMessage
+	for _, e := range entries {
+		reqParse := NewPgMessage(IdentifiesParse)
+		reqParse.addString(e.Name)
+		reqParse.addString(e.SQL)
+		reqParse.addInt16(0)
+
+		reqDes := NewPgMessage(IdentifiesDescribe)
+		reqDes.addByte('S')
+		reqDes.addString(e.Name)
+		list = append(list, reqParse, reqDes, NewPgMessage(IdentifiesSync))
+	}
+	if err = pi.send(list...); err != nil {
+		return
+	}
+
+	results = make([]BatchResult, len(entries))
+	for i := range entries {
+		ms, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+		if err != nil {
+			return results, err
+		}
+		var r = &results[i]
+		for _, v := range ms {
+			switch v.Identifies {
+			case IdentifiesErrorResponse:
+				r.Err = v.ParseError()
+			case IdentifiesParameterDescription:
+				var pn = v.int16()
+				for n := uint16(0); n < pn; n++ {
+					r.ParameterTypes = append(r.ParameterTypes, v.int32())
+				}
+			case IdentifiesRowDescription:
+				r.Columns = v.columns()
+			case IdentifiesReadyForQuery:
+				pi.txStatus = TransactionStatus(v.byte())
+			}
+			if v.overrun && r.Err == nil {
+				r.Err = ErrMalformedMessage
+			}
+		}
+	}
+	return
+}
+
+// ParseExec 执行预备语句，返回影响的行数。oid 为 INSERT 单行到带 OID 的表时的新行 OID，
+// 仅 PostgreSQL 12 之前的版本可能非 0
+func (pi *PgIO) ParseExec(name string, args []interface{}) (oid uint32, n int, err error) {
+	return pi.ParseExecPortal("", name, args)
+}
+
+// ParseExecPortal 与 ParseExec 相同，但绑定到名为 portal 的门户。
+// 命名门户在显式关闭（ClosePortal）或事务结束前一直存在，不在事务中时随 Sync 结束
+func (pi *PgIO) ParseExecPortal(portal, name string, args []interface{}) (oid uint32, n int, err error) {
+	if err = pi.ReceiveAsync(); err != nil {
+		return
+	}
+	rBind := newBind(portal, name, args, nil)
+	rExec := NewPgMessage(IdentifiesExecute)
+	rExec.addString(portal)
+	rExec.addInt32(0) // all rows
+	err = pi.send(rBind, rExec, NewPgMessage(IdentifiesSync))
+	if err != nil {
+		return
+	}
+	list, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	if err != nil {
+		return
+	}
+	for _, v := range list {
+		switch v.Identifies {
+		case IdentifiesErrorResponse:
+			err = v.ParseError()
+		case IdentifiesCommandComplete:
+			var rows int64
+			_, oid, rows, _ = helper.ParseCommandComplete(v.string())
+			n = int(rows)
+		case IdentifiesEmptyQueryResponse:
+			n = 0
+		case IdentifiesReadyForQuery:
+			pi.txStatus = TransactionStatus(v.byte())
+		}
+		if v.overrun && err == nil {
+			err = ErrMalformedMessage
+		}
+	}
+	return
+}
+
+// newBind 将参数以文本格式绑定到门户 portal，为空时是未命名门户。
+// formats 为各结果列的传输格式，为空时全部使用文本格式
+func newBind(portal, name string, args []interface{}, formats []uint16) *PgMessage {
 	rBind := NewPgMessage(IdentifiesBind)
-	rBind.addString("")
+	rBind.addString(portal)
 	rBind.addString(name)
 	rBind.addInt16(0)
 	rBind.addInt16(len(args))
@@ -365,9 +1114,92 @@ func (pi *PgIO) ParseQuery(name string, args []interface{}) (fieldLen *[][]uint3
 			rBind.addBytes(b)
 		}
 	}
-	rBind.addInt16(0)
+	rBind.addInt16(len(formats))
+	for _, f := range formats {
+		rBind.addInt16(int(f))
+	}
+	return rBind
+}
+
+// ParseAndExecBatch 在一次往返中执行多条语句：全部 Parse、Bind、Execute 之后只跟一个 Sync，
+// 返回每条语句影响的行数。不在事务中时，整批语句在同一个隐式事务中执行。
+// 某条语句出错时服务端跳过其后的全部语句，这些语句及出错语句的行数为 -1，
+// 返回的 *BatchError 指明出错的语句；在显式事务中出错时，事务进入失败状态
+func (pi *PgIO) ParseAndExecBatch(ctx context.Context, stmts []BatchStmt) (counts []int, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var list []*PgMessage
+	for _, st := range stmts {
+		if st.SQL != "" {
+			reqParse := NewPgMessage(IdentifiesParse)
+			reqParse.addString(st.Name)
+			reqParse.addString(st.SQL)
+			reqParse.addInt16(0)
+			list = append(list, reqParse)
+		}
+		rExec := NewPgMessage(IdentifiesExecute)
+		rExec.addString("")
+		rExec.addInt32(0)
+		list = append(list, newBind("", st.Name, st.Args, nil), rExec)
+	}
+	defer pi.WatchCancel(ctx)()
+	if err = pi.send(append(list, NewPgMessage(IdentifiesSync))...); err != nil {
+		return
+	}
+	msgs, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	if err != nil {
+		return
+	}
+	counts = make([]int, len(stmts))
+	var i int
+	for _, v := range msgs {
+		switch v.Identifies {
+		case IdentifiesErrorResponse:
+			if err == nil {
+				err = &BatchError{Index: i, Err: v.ParseError()}
+			}
+		case IdentifiesCommandComplete:
+			_, _, rows, _ := helper.ParseCommandComplete(v.string())
+			if i < len(counts) {
+				counts[i] = int(rows)
+			}
+			i++
+		case IdentifiesEmptyQueryResponse:
+			i++
+		case IdentifiesReadyForQuery:
+			pi.txStatus = TransactionStatus(v.byte())
+		}
+		if v.overrun && err == nil {
+			err = ErrMalformedMessage
+		}
+	}
+	for ; i < len(counts); i++ {
+		counts[i] = -1
+	}
+	return
+}
+
+// data 使用指针减少copy时的内存损耗
+func (pi *PgIO) ParseQuery(name string, args []interface{}) (fieldLen *[][]uint32, data *[][][]byte, err error) {
+	return pi.parseQuery("", name, args, nil)
+}
+
+// ParseQueryPortal 与 ParseQuery 相同，但绑定到名为 portal 的门户，门户的生命周期见 ParseExecPortal
+func (pi *PgIO) ParseQueryPortal(portal, name string, args []interface{}) (fieldLen *[][]uint32, data *[][][]byte, err error) {
+	return pi.parseQuery(portal, name, args, nil)
+}
+
+// ParseQueryFormats 与 ParseQuery 相同，但按 formats 逐列指定结果的传输格式（FormatText、FormatBinary），
+// 为空时全部使用文本格式
+func (pi *PgIO) ParseQueryFormats(name string, args []interface{}, formats []uint16) (fieldLen *[][]uint32, data *[][][]byte, err error) {
+	return pi.parseQuery("", name, args, formats)
+}
+
+func (pi *PgIO) parseQuery(portal, name string, args []interface{}, formats []uint16) (fieldLen *[][]uint32, data *[][][]byte, err error) {
+	rBind := newBind(portal, name, args, formats)
 	rExec := NewPgMessage(IdentifiesExecute)
-	rExec.addString("")
+	rExec.addString(portal)
 	rExec.addInt32(0) // all rows
 	err = pi.send(rBind, rExec, NewPgMessage(IdentifiesSync))
 	if err != nil {
@@ -383,30 +1215,159 @@ func (pi *PgIO) ParseQuery(name string, args []interface{}) (fieldLen *[][]uint3
 	for _, v := range list {
 		switch v.Identifies {
 		case IdentifiesErrorResponse:
+			// 出错前已收到的行不完整，丢弃
 			err = v.ParseError()
+			*fieldLen, *data = (*fieldLen)[:0], (*data)[:0]
 		case IdentifiesDataRow:
-			var rowLen = new([]uint32)
-			var row = new([][]byte)
-			length := v.int16()
-			for i := uint16(0); i < length; i++ {
-				l := v.int32()
-				if l == 4294967295 {
-					// nil
-					*row = append(*row, nil)
-				} else {
-					*row = append(*row, v.bytes(l))
-				}
-				*rowLen = append(*rowLen, l)
+			if err != nil {
+				break
 			}
-			*fieldLen = append(*fieldLen, *rowLen)
-			*data = append(*data, *row)
+			rowLen, row := v.dataRow()
+			*fieldLen = append(*fieldLen, rowLen)
+			*data = append(*data, row)
 		case IdentifiesReadyForQuery:
 			pi.txStatus = TransactionStatus(v.byte())
 		}
+		if v.overrun && err == nil {
+			err = ErrMalformedMessage
+		}
+	}
+	return
+}
+
+// ParseQueryFetchContext 将预备语句绑定到门户 portal 并执行，最多取回 maxRows 行，结果格式见 ParseQueryFormats。
+// 门户因行数上限挂起时 suspended 为 true：扩展查询尚未以 Sync 结束，门户在隐式事务中一直有效，
+// 须以 FetchPortal 继续获取直到 suspended 为 false，或以 ClosePortal 提前结束，其间开始其他请求见 SetPortalDrain。
+// ctx 只作用于本次调用，处理方式同 ParseQueryContext
+func (pi *PgIO) ParseQueryFetchContext(ctx context.Context, portal, name string, args []interface{}, formats []uint16, maxRows int) (fieldLen *[][]uint32, data *[][][]byte, suspended bool, err error) {
+	stop, err := pi.watchContext(ctx)
+	if err != nil {
+		return
+	}
+	defer stop()
+	return pi.fetch(portal, maxRows, newBind(portal, name, args, formats))
+}
+
+// FetchPortal 从 ParseQueryFetchContext 挂起的门户继续取回最多 maxRows 行
+func (pi *PgIO) FetchPortal(portal string, maxRows int) (fieldLen *[][]uint32, data *[][][]byte, suspended bool, err error) {
+	if !pi.portalSuspended {
+		return nil, nil, false, fmt.Errorf("pg: portal %q is not suspended", portal)
+	}
+	return pi.fetch(portal, maxRows)
+}
+
+// SetPortalDrain 设置门户挂起期间开始新请求时的处理函数：fn 应以 FetchPortal 读完剩余的行或以 ClosePortal 关闭门户，
+// 之后新请求照常发送。门户结束后自动清除。未设置时新请求返回 ErrPortalSuspended
+func (pi *PgIO) SetPortalDrain(fn func() error) {
+	if pi.portalSuspended {
+		pi.drainPortal = fn
+	}
+}
+
+// continueSend 门户挂起时消息属于尚未结束的扩展查询，绕过 send 的检查直接写出
+func (pi *PgIO) continueSend(list ...*PgMessage) error {
+	if pi.portalSuspended {
+		return pi.write(list...)
+	}
+	return pi.send(list...)
+}
+
+// fetch 在 list 之后以行数上限 maxRows 执行门户，只发送 Flush；门户执行完或出错时才以 Sync 结束
+func (pi *PgIO) fetch(portal string, maxRows int, list ...*PgMessage) (fieldLen *[][]uint32, data *[][][]byte, suspended bool, err error) {
+	fieldLen = new([][]uint32)
+	data = new([][][]byte)
+	rExec := NewPgMessage(IdentifiesExecute)
+	rExec.addString(portal)
+	rExec.addInt32(maxRows)
+	var send = pi.send
+	if len(list) == 0 {
+		// 继续获取挂起的门户
+		send = pi.continueSend
+	}
+	if err = send(append(list, rExec, NewPgMessage(IdentifiesFlush))...); err != nil {
+		return
+	}
+	suspended, err = pi.receiveBatch(fieldLen, data)
+	if suspended || pi.IOError != nil {
+		pi.portalSuspended = suspended
+		return
+	}
+	if _, ok := err.(*PgError); ok {
+		// 出错前已收到的行不完整，丢弃
+		*fieldLen, *data = (*fieldLen)[:0], (*data)[:0]
+	}
+	if e := pi.Sync(); err == nil {
+		err = e
 	}
 	return
 }
 
+// receiveBatch 读取一次 Execute 的结果，门户因行数上限挂起时 suspended 为 true
+func (pi *PgIO) receiveBatch(fieldLen *[][]uint32, data *[][][]byte) (suspended bool, err error) {
+	for {
+		msg, err := pi.receivePgMsgOnce()
+		if err != nil {
+			return false, err
+		}
+		switch msg.Identifies {
+		case IdentifiesDataRow:
+			rowLen, row := msg.dataRow()
+			if msg.overrun {
+				return false, ErrMalformedMessage
+			}
+			*fieldLen = append(*fieldLen, rowLen)
+			*data = append(*data, row)
+		case IdentifiesPortalSuspended:
+			return true, nil
+		case IdentifiesCommandComplete, IdentifiesEmptyQueryResponse:
+			return false, nil
+		}
+	}
+}
+
+// cancelGracePeriod ctx 到期并发出 CancelRequest 后，留给服务端返回 ErrorResponse 的时间。
+// 超出后连接的读写超时生效，连接作废
+const cancelGracePeriod = 5 * time.Second
+
+// ParseQueryContext 与 ParseQuery 相同，但在 ctx 结束时向服务端发送 CancelRequest。
+// ctx 带有截止时间时同时设置连接的读写超时，防止服务端无响应时永久阻塞
+func (pi *PgIO) ParseQueryContext(ctx context.Context, name string, args []interface{}) (fieldLen *[][]uint32, data *[][][]byte, err error) {
+	return pi.ParseQueryContextFormats(ctx, name, args, nil)
+}
+
+// ParseQueryContextFormats 与 ParseQueryContext 相同，结果的传输格式见 ParseQueryFormats
+func (pi *PgIO) ParseQueryContextFormats(ctx context.Context, name string, args []interface{}, formats []uint16) (fieldLen *[][]uint32, data *[][][]byte, err error) {
+	stop, err := pi.watchContext(ctx)
+	if err != nil {
+		return
+	}
+	defer stop()
+	return pi.ParseQueryFormats(name, args, formats)
+}
+
+// watchContext ctx 带有截止时间时设置连接的读写超时，并在 ctx 结束时发送 CancelRequest。
+// 返回的函数撤销二者，须在本次请求结束时调用
+func (pi *PgIO) watchContext(ctx context.Context) (stop func(), err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var clear = func() {}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = pi.setDeadline(deadline.Add(cancelGracePeriod)); err != nil {
+			pi.IOError = err
+			return
+		}
+		clear = func() {
+			_ = pi.setDeadline(time.Time{})
+		}
+	}
+	var stopCancel = pi.WatchCancel(ctx)
+	return func() {
+		stopCancel()
+		clear()
+	}, nil
+}
+
 func (pi *PgIO) CloseParse(name string) (err error) {
 	rc := NewPgMessage(IdentifiesClose)
 	rc.addByte('S')
@@ -430,12 +1391,116 @@ func (pi *PgIO) CloseParse(name string) (err error) {
 	return
 }
 
+// CloseParseAsync 关闭预备语句但不等待响应：Close 暂存起来，随下一次请求
+// 一起发送，省去一次往返。暂存的 Close 先于同一批的 Parse 发送，重新预备同名语句是安全的
+func (pi *PgIO) CloseParseAsync(name string) error {
+	rc := NewPgMessage(IdentifiesClose)
+	rc.addByte('S')
+	rc.addString(name)
+	if rc.err != nil {
+		return rc.err
+	}
+	pi.pendingCloses = append(pi.pendingCloses, rc)
+	return nil
+}
+
+// sendPendingCloses 在 list 之前发送暂存的 Close 及一个 Sync，并读取到该 Sync 的 ReadyForQuery。
+// Close 单独成组，失败时不影响之后的请求；关闭语句只为释放资源，其错误被忽略
+func (pi *PgIO) sendPendingCloses(list ...*PgMessage) (err error) {
+	var all = append(pi.pendingCloses[:len(pi.pendingCloses):len(pi.pendingCloses)], NewPgMessage(IdentifiesSync))
+	if err = pi.write(append(all, list...)...); err != nil {
+		return
+	}
+	pi.pendingCloses = nil
+	ms, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	if err != nil {
+		return
+	}
+	pi.txStatus = TransactionStatus(ms[len(ms)-1].byte())
+	return
+}
+
+// ClosePortal 关闭门户。执行到行数上限而挂起的门户在事务结束前一直占用服务端资源，
+// 提前结束读取时需要显式关闭
+func (pi *PgIO) ClosePortal(name string) (err error) {
+	rc := NewPgMessage(IdentifiesClose)
+	rc.addByte('P')
+	rc.addString(name)
+
+	err = pi.continueSend(rc, NewPgMessage(IdentifiesSync))
+	if err != nil {
+		return
+	}
+	list, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	if err != nil {
+		return
+	}
+	for _, v := range list {
+		if v.Identifies == IdentifiesReadyForQuery {
+			pi.txStatus = TransactionStatus(v.byte())
+		} else if v.Identifies == IdentifiesErrorResponse {
+			err = v.ParseError()
+		}
+	}
+	return
+}
+
+// WatchCancel 在 ctx 结束时向服务端发送 CancelRequest，直到调用返回的 done 为止。
+// 用法：defer pi.WatchCancel(ctx)()
+//
+// 取消请求经另一个连接到达，服务端可能在查询结束后才收到，从而取消同一连接上的下一条语句。
+// 因此已发出取消请求时，done 等待其发送完毕并将连接标记为不可用
+func (pi *PgIO) WatchCancel(ctx context.Context) (done func()) {
+	var sent = make(chan bool, 1)
+	stop := afterCancel(ctx, func() {
+		sent <- pi.CancelRequest() == nil
+	})
+	return func() {
+		if !stop() && <-sent && pi.IOError == nil {
+			pi.IOError = ErrCancelPending
+		}
+	}
+}
+
+// cancelTimeout 发送取消请求的总时限，包括拨号及写出
+const cancelTimeout = 5 * time.Second
+
 func (pi *PgIO) CancelRequest() (err error) {
-	var nIO = NewPgIO(pi.dsn)
-	err = nIO.Dial(pi.dsn.Address())
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	var network, address, _ = pi.dsn.Address()
+	return pi.CancelRequestContext(ctx, network, address)
+}
+
+// CancelRequestTo 向指定地址发送取消请求。多主机时，取消请求必须发往执行查询的那台主机。
+func (pi *PgIO) CancelRequestTo(network, address string, timeout time.Duration) (err error) {
+	var ctx = context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return pi.CancelRequestContext(ctx, network, address)
+}
+
+// CancelRequestContext 同 CancelRequestTo，拨号及写出都受 ctx 限制，网络分区时不会一直阻塞
+func (pi *PgIO) CancelRequestContext(ctx context.Context, network, address string) (err error) {
+	if !pi.backendKeyReceived {
+		// 没有密钥时发出的取消请求不会生效，还可能误取消其它会话
+		return ErrCancelNotSupported
+	}
+	// 取消请求只在查询执行期间有意义，不重试
+	var dsn = *pi.dsn
+	dsn.ConnectRetries = 0
+	var nIO = NewPgIO(&dsn)
+	err = nIO.DialContext(ctx, network, address, 0)
 	if err != nil {
 		return
 	}
+	defer nIO.conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = nIO.conn.SetWriteDeadline(deadline)
+	}
 	rc := NewPgMessage(IdentifiesCancelRequest)
 	rc.addInt32(80877102)
 	rc.addInt32(int(pi.serverPid))
@@ -443,19 +1508,162 @@ func (pi *PgIO) CancelRequest() (err error) {
 
 	_ = rc.encode()
 	_, err = nIO.conn.Write(rc.Content)
-	if err != nil {
-		return
-	}
-	defer nIO.conn.Close()
 	return
 }
 
+// Terminate 发送 Terminate 后，在 TerminateTimeout 内读完服务端剩余的数据，等待其关闭连接，
+// 避免服务端记录 connection reset by peer
 func (pi *PgIO) Terminate() (err error) {
 	rc := NewPgMessage(IdentifiesTerminate)
 	err = pi.send(rc)
+	if err == nil {
+		_ = pi.conn.SetReadDeadline(time.Now().Add(pi.dsn.TerminateTimeout))
+		_, _ = io.Copy(ioutil.Discard, pi.conn)
+	}
+	_ = pi.conn.Close()
+	pi.IOError = driver.ErrBadConn
+	return
+}
+
+// ReceiveAsync 处理查询之间服务端主动发来、且已读入缓冲区的异步消息：NotificationResponse、
+// ParameterStatus 及 NoticeResponse，分别交给对应的处理函数。
+// 只检查缓冲区，不阻塞也不产生系统调用；遇到不完整的消息或非异步消息时停止，留给后续的读取
+func (pi *PgIO) ReceiveAsync() error {
+	if pi.reader == nil {
+		return nil
+	}
+	for pi.reader.Buffered() >= 5 {
+		head, _ := pi.reader.Peek(5)
+		switch Identifies(head[0]) {
+		case IdentifiesNotificationResponse, IdentifiesParameterStatus, IdentifiesNoticeResponse:
+		default:
+			return nil
+		}
+		if uint64(pi.reader.Buffered()) < 1+uint64(binary.BigEndian.Uint32(head[1:])) {
+			return nil
+		}
+		msg, err := pi.receivePgMsgOnce()
+		if err != nil {
+			return err
+		}
+		if msg.Identifies == IdentifiesNotificationResponse && pi.NotificationHandler != nil {
+			var n = msg.notification()
+			if msg.overrun {
+				pi.IOError = ErrMalformedMessage
+				return ErrMalformedMessage
+			}
+			pi.NotificationHandler(n)
+		}
+	}
+	return nil
+}
+
+// WaitForNotification 阻塞直到收到 NotificationResponse 或 ctx 结束，期间的其它异步消息被忽略。
+// 调用前需先执行 LISTEN；等待期间该连接不能用于其它查询，应使用专用的连接。
+// ctx 结束时连接仍然可用，需要定期唤醒（如检查退出信号）时传入带截止时间的 ctx 即可
+func (pi *PgIO) WaitForNotification(ctx context.Context) (*Notification, error) {
+	if pi.IOError != nil {
+		return nil, driver.ErrBadConn
+	}
+	for {
+		if err := pi.waitReadable(ctx); err != nil {
+			return nil, err
+		}
+		msg, err := pi.receivePgMsgOnce()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Identifies == IdentifiesNotificationResponse {
+			var n = msg.notification()
+			if msg.overrun {
+				return nil, ErrMalformedMessage
+			}
+			return n, nil
+		}
+	}
+}
+
+// waitReadable 等待连接上有数据可读，不消费数据。
+// ctx 只在消息之间生效，避免读到一半的消息破坏连接状态：ctx 的截止时间直接作为读截止时间，
+// ctx 提前取消时再把读截止时间改为当前时刻
+func (pi *PgIO) waitReadable(ctx context.Context) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var deadline = pi.deadline
+	if d, ok := ctx.Deadline(); ok {
+		deadline = earlier(d, deadline)
+	}
+	_ = pi.conn.SetReadDeadline(deadline)
+	var stop = func() bool { return true }
+	var fired = make(chan struct{})
+	if ctx.Done() != nil {
+		stop = afterCancel(ctx, func() {
+			_ = pi.conn.SetReadDeadline(time.Now())
+			close(fired)
+		})
+	}
+	_, err = pi.reader.Peek(1)
+	if !stop() {
+		<-fired
+	}
+	_ = pi.conn.SetReadDeadline(pi.deadline)
 	if err != nil {
-		_ = pi.conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// 读截止时间可能先于 ctx 自身的计时器到期
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			return context.DeadlineExceeded
+		}
+		pi.IOError = err
+	}
+	return
+}
+
+// HealthCheck 不发送任何消息，只检查空闲连接是否仍然可用：
+// 以极短的读超时窥探连接，读超时说明连接正常；读到 EOF 或服务端主动发来的 ErrorResponse
+// （如管理员终止了会话）说明连接已失效，返回 driver.ErrBadConn
+func (pi *PgIO) HealthCheck() error {
+	if pi.IOError != nil || pi.conn == nil {
+		return driver.ErrBadConn
+	}
+	// 已过期的 deadline 会让 Read 不经系统调用直接超时，因此留出 1ms
+	if err := pi.conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		pi.IOError = err
+		return driver.ErrBadConn
+	}
+	b, err := pi.reader.Peek(1)
+	_ = pi.conn.SetReadDeadline(pi.deadline)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		pi.IOError = err
+		return driver.ErrBadConn
+	}
+	if Identifies(b[0]) == IdentifiesErrorResponse {
 		pi.IOError = driver.ErrBadConn
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// RecoverFromFailedTransaction 事务中的语句出错后，服务端拒绝执行 ROLLBACK 以外的任何命令。
+// 发送 ROLLBACK 结束失败的事务，使连接可以继续使用；不在失败的事务中时什么也不做
+func (pi *PgIO) RecoverFromFailedTransaction(ctx context.Context) (err error) {
+	if pi.txStatus != TransactionStatusInFailedTransaction {
+		return nil
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	defer pi.WatchCancel(ctx)()
+	if _, _, _, err = pi.QueryNoArgs("rollback"); err != nil {
+		return
+	}
+	if pi.txStatus != TransactionStatusIdle {
+		return fmt.Errorf("pg: transaction status is %q after rollback", pi.txStatus)
 	}
 	return
 }
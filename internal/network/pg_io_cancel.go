@@ -0,0 +1,18 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build go1.21
+// +build go1.21
+
+package network
+
+import "context"
+
+// afterCancel 在 ctx 结束时调用 f，返回的 stop 用于撤销。
+// 基于 context.AfterFunc，不必为每个查询启动一个 goroutine
+func afterCancel(ctx context.Context, f func()) (stop func() bool) {
+	return context.AfterFunc(ctx, f)
+}
@@ -0,0 +1,35 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build !go1.21
+// +build !go1.21
+
+package network
+
+import "context"
+
+// afterCancel 在 ctx 结束时调用 f，返回的 stop 用于撤销。
+// Go 1.21 之前没有 context.AfterFunc，仍由 goroutine 监听。f 已开始时 stop 等待其结束
+func afterCancel(ctx context.Context, f func()) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return true }
+	}
+	var finished = make(chan struct{})
+	var result = make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f()
+			result <- false
+		case <-finished:
+			result <- true
+		}
+	}()
+	return func() bool {
+		close(finished)
+		return <-result
+	}
+}
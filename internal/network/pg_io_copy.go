@@ -0,0 +1,111 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import (
+	"github.com/blusewang/pg/internal/helper"
+	"io"
+)
+
+const copyChunkSize = 64 * 1024
+
+// CopyFrom 执行 COPY ... FROM STDIN，把 r 中已按COPY格式编码的数据发送给服务端，返回写入的行数
+func (pi *PgIO) CopyFrom(query string, r io.Reader) (n int64, err error) {
+	sq := NewPgMessage(IdentifiesQuery)
+	sq.addString(query)
+	err = pi.send(sq)
+	if err != nil {
+		return
+	}
+
+	for {
+		m, err := pi.receivePgMsgOnce()
+		if err != nil {
+			if _, ok := err.(*PgError); ok {
+				_, _ = pi.receivePgMsg(IdentifiesReadyForQuery)
+			}
+			return 0, err
+		}
+		if m.Identifies == IdentifiesCopyInResponse {
+			break
+		}
+	}
+
+	var buf = make([]byte, copyChunkSize)
+	var readErr error
+	for {
+		var l int
+		l, readErr = r.Read(buf)
+		if l > 0 {
+			data := NewPgMessage(IdentifiesCopyData)
+			data.addBytes(buf[:l])
+			if err = pi.send(data); err != nil {
+				return
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if readErr == io.EOF {
+		err = pi.send(NewPgMessage(IdentifiesCopyDone))
+	} else {
+		fail := NewPgMessage(IdentifiesCopyFail)
+		fail.addString(readErr.Error())
+		err = pi.send(fail)
+	}
+	if err != nil {
+		return
+	}
+
+	list, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	if err != nil {
+		return
+	}
+	for _, v := range list {
+		switch v.Identifies {
+		case IdentifiesErrorResponse:
+			err = v.ParseError()
+		case IdentifiesCommandComplete:
+			_, _, n, _ = helper.ParseCommandComplete(v.string())
+		case IdentifiesReadyForQuery:
+			pi.txStatus = TransactionStatus(v.byte())
+		}
+		if v.overrun && err == nil {
+			err = ErrMalformedMessage
+		}
+	}
+	return
+}
+
+// AppendCopyText 按 COPY 文本格式编码一行：列以 \t 分隔，NULL 为 \N，以 \n 结尾
+func AppendCopyText(buf []byte, row []interface{}) []byte {
+	for i, v := range row {
+		if i > 0 {
+			buf = append(buf, '\t')
+		}
+		if v == nil {
+			buf = append(buf, `\N`...)
+			continue
+		}
+		for _, c := range value2bytes(v) {
+			switch c {
+			case '\\':
+				buf = append(buf, `\\`...)
+			case '\n':
+				buf = append(buf, `\n`...)
+			case '\r':
+				buf = append(buf, `\r`...)
+			case '\t':
+				buf = append(buf, `\t`...)
+			default:
+				buf = append(buf, c)
+			}
+		}
+	}
+	return append(buf, '\n')
+}
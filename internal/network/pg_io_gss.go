@@ -0,0 +1,64 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import (
+	"fmt"
+)
+
+// GSS GSSAPI 认证的客户端实现，以 -tags kerberos 编译时由 pg_io_gss_krb5.go 提供
+type GSS interface {
+	// GetInitToken 为服务 service/host 生成首个令牌
+	GetInitToken(host, service string) ([]byte, error)
+	// Continue 处理服务端返回的令牌，done 为 true 时认证结束
+	Continue(inToken []byte) (done bool, outToken []byte, err error)
+}
+
+// newGSS 未以 -tags kerberos 编译时为 nil
+var newGSS func(user string) (GSS, error)
+
+// GSSAPI 认证：发送首个令牌后，根据 AuthenticationGSSContinue(8) 继续交换，直到 AuthenticationOk
+func (pi *PgIO) authGSS() (err error) {
+	if newGSS == nil {
+		return fmt.Errorf("unsupported authentication method GSSAPI: code 7, build with -tags kerberos to enable it")
+	}
+	g, err := newGSS(pi.dsn.Parameter["user"])
+	if err != nil {
+		return
+	}
+	token, err := g.GetInitToken(pi.dsn.Host, pi.dsn.KrbSrvName)
+	if err != nil {
+		return
+	}
+	for {
+		if len(token) > 0 {
+			resp := NewPgMessage(IdentifiesGSSResponse)
+			resp.addBytes(token)
+			if err = pi.send(resp); err != nil {
+				return
+			}
+		}
+		m, err := pi.receivePgMsgOnce()
+		if err != nil {
+			return err
+		}
+		if m.Identifies != IdentifiesAuth {
+			return fmt.Errorf("unexpected message during GSSAPI authentication: %q", m.Identifies)
+		}
+		switch code := m.int32(); code {
+		case 0:
+			return nil
+		case 8:
+			_, token, err = g.Continue(m.bytes(m.Len - m.Position))
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected authentication response during GSSAPI authentication: code %d", code)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"github.com/blusewang/pg/internal/helper"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 标识符最长 NAMEDATALEN-1 字节
+const maxIdentifierLen = 63
+
+// ListenMulti 在一次简单查询中订阅多个通知频道。频道名总是加双引号，区分大小写
+func (pi *PgIO) ListenMulti(ctx context.Context, channels ...string) error {
+	return pi.listenCommand(ctx, "listen", channels)
+}
+
+// UnlistenMulti 在一次简单查询中取消订阅多个通知频道
+func (pi *PgIO) UnlistenMulti(ctx context.Context, channels ...string) error {
+	return pi.listenCommand(ctx, "unlisten", channels)
+}
+
+// UnlistenAll 取消本会话的全部订阅
+func (pi *PgIO) UnlistenAll(ctx context.Context) (err error) {
+	defer pi.WatchCancel(ctx)()
+	_, _, _, err = pi.QueryNoArgs("unlisten *")
+	return
+}
+
+func (pi *PgIO) listenCommand(ctx context.Context, command string, channels []string) (err error) {
+	if len(channels) == 0 {
+		return nil
+	}
+	var list = make([]string, len(channels))
+	for i, ch := range channels {
+		if list[i], err = quoteChannel(ch); err != nil {
+			return
+		}
+		list[i] = command + " " + list[i]
+	}
+	defer pi.WatchCancel(ctx)()
+	_, _, _, err = pi.QueryNoArgs(strings.Join(list, "; "))
+	return
+}
+
+// quoteChannel 按标识符的规则检查频道名并加上双引号
+func quoteChannel(name string) (string, error) {
+	if name == "" || len(name) > maxIdentifierLen || !utf8.ValidString(name) {
+		return "", fmt.Errorf("pg: invalid channel name %q", name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("pg: invalid channel name %q", name)
+		}
+	}
+	return helper.QuoteIdentifier(name)
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+const (
+	saslScramSHA256     = "SCRAM-SHA-256"
+	saslScramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// parseSASLMechanisms 读取 AuthenticationSASL(10) 中服务端提供的机制名，以空字符串结尾
+func parseSASLMechanisms(msg PgMessage) (list []string) {
+	// 跳过长度及认证码
+	msg.Position = 8
+	for {
+		name := msg.string()
+		if name == "" || msg.overrun {
+			return
+		}
+		list = append(list, name)
+	}
+}
+
+// selectSASLMechanism 按安全性选择机制：TLS 连接上优先使用带通道绑定的 SCRAM-SHA-256-PLUS
+func selectSASLMechanism(offered []string, tlsAvailable bool) (string, error) {
+	var has = make(map[string]bool, len(offered))
+	for _, name := range offered {
+		has[name] = true
+	}
+	if tlsAvailable && has[saslScramSHA256Plus] {
+		return saslScramSHA256Plus, nil
+	}
+	if has[saslScramSHA256] {
+		return saslScramSHA256, nil
+	}
+	return "", fmt.Errorf("pg: no supported SASL mechanism offered by server: %v", strings.Join(offered, ", "))
+}
+
+// SASL 认证：选出机制后交由 SCRAM 实现，目前尚未支持
+func (pi *PgIO) authSASL(msg PgMessage) error {
+	_, tlsAvailable := pi.conn.(*tls.Conn)
+	mechanism, err := selectSASLMechanism(parseSASLMechanisms(msg), tlsAvailable)
+	if err != nil {
+		return err
+	}
+	return errUnsupportedAuth(10, "SASL "+mechanism)
+}
@@ -0,0 +1,37 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectSASLMechanism(t *testing.T) {
+	m := NewPgMessage(IdentifiesAuth)
+	m.addInt32(10)
+	m.addString(saslScramSHA256)
+	m.addString(saslScramSHA256Plus)
+	m.addString("")
+	offered := parseSASLMechanisms(testReceived(m))
+	if !reflect.DeepEqual(offered, []string{saslScramSHA256, saslScramSHA256Plus}) {
+		t.Fatal(offered)
+	}
+
+	if v, err := selectSASLMechanism(offered, true); err != nil || v != saslScramSHA256Plus {
+		t.Fatal(v, err)
+	}
+	if v, err := selectSASLMechanism(offered, false); err != nil || v != saslScramSHA256 {
+		t.Fatal(v, err)
+	}
+	if v, err := selectSASLMechanism([]string{saslScramSHA256Plus}, false); err == nil {
+		t.Fatal(v)
+	}
+	if v, err := selectSASLMechanism([]string{"OAUTHBEARER"}, true); err == nil {
+		t.Fatal(v)
+	}
+}
@@ -7,14 +7,16 @@
 package network
 
 import (
-	"bufio"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"github.com/blusewang/pg/internal/helper"
 	"io/ioutil"
 	"os"
 )
 
+var errSSLNotSupported = errors.New("pq: SSL is not enabled on the server")
+
 func (pi *PgIO) ssl() (err error) {
 	code, err := pi.sslRequest()
 	if err != nil {
@@ -23,33 +25,43 @@ func (pi *PgIO) ssl() (err error) {
 	}
 
 	switch pi.dsn.SSL.Mode {
-	case "prefer":
+	case helper.SSLModePrefer:
+		// 服务端不支持SSL时，继续使用明文连接
 		if code == 'N' {
 			return nil
-		} else if err = pi.sslCheck(); err != nil {
-			return nil
 		}
 		pi.tlsConfig.InsecureSkipVerify = true
-	case "require":
+	case helper.SSLModeAllow:
+		// 明文连接被拒绝后才会走到这里，不校验证书
 		if code == 'N' {
-			pi.IOError = errors.New("pq: SSL is not enabled on the server")
-			return nil
+			pi.IOError = errSSLNotSupported
+			return pi.IOError
 		}
-		// 如果没有根证书，标记为只验证证书
+		pi.tlsConfig.InsecureSkipVerify = true
+	case helper.SSLModeRequire:
+		if code == 'N' {
+			pi.IOError = errSSLNotSupported
+			return pi.IOError
+		}
+		pi.tlsConfig.InsecureSkipVerify = true
+		// 与libpq一致：存在根证书时，按 verify-ca 校验证书链
 		if _, err = os.Stat(pi.dsn.SSL.RootCert); err == nil {
-			pi.tlsConfig.InsecureSkipVerify = true
+			pi.tlsConfig.VerifyPeerCertificate = pi.verifyCA
 		}
-	case "verify-ca":
+	case helper.SSLModeVerifyCA:
 		if code == 'N' {
-			pi.IOError = errors.New("pq: SSL is not enabled on the server")
-			return nil
+			pi.IOError = errSSLNotSupported
+			return pi.IOError
 		}
+		// 跳过标准库的主机名校验，证书链由 verifyCA 校验
 		pi.tlsConfig.InsecureSkipVerify = true
-	case "verify-full":
+		pi.tlsConfig.VerifyPeerCertificate = pi.verifyCA
+	case helper.SSLModeVerifyFull:
 		if code == 'N' {
-			pi.IOError = errors.New("pq: SSL is not enabled on the server")
-			return nil
+			pi.IOError = errSSLNotSupported
+			return pi.IOError
 		}
+		pi.tlsConfig.InsecureSkipVerify = false
 		pi.tlsConfig.ServerName = pi.dsn.Host
 
 	default:
@@ -66,8 +78,12 @@ func (pi *PgIO) ssl() (err error) {
 
 	pi.tlsConfig.Renegotiation = tls.RenegotiateFreelyAsClient
 
-	pi.conn = tls.Client(pi.conn, &pi.tlsConfig)
-	pi.reader = bufio.NewReader(pi.conn)
+	var conn = tls.Client(pi.conn, &pi.tlsConfig)
+	if err = conn.Handshake(); err != nil {
+		pi.IOError = err
+		return err
+	}
+	pi.setConn(conn)
 
 	return
 }
@@ -86,14 +102,15 @@ func (pi *PgIO) sslRequest() (code byte, err error) {
 }
 
 func (pi *PgIO) sslCheck() (err error) {
-	if pi.dsn.SSL.Mode == "verify-ca" || pi.dsn.SSL.Mode == "verify-full" {
+	if pi.dsn.SSL.Mode == helper.SSLModeVerifyCA || pi.dsn.SSL.Mode == helper.SSLModeVerifyFull {
 		if _, err = os.Stat(pi.dsn.SSL.RootCert); err != nil {
 			return err
 		}
 	}
 
+	// 客户端证书是可选的
 	if _, err = os.Stat(pi.dsn.SSL.Cert); err != nil {
-		return err
+		return nil
 	}
 
 	info, err := os.Stat(pi.dsn.SSL.Key)
@@ -108,11 +125,13 @@ func (pi *PgIO) sslCheck() (err error) {
 }
 
 func (pi *PgIO) sslConfig() (err error) {
-	cert, err := tls.LoadX509KeyPair(pi.dsn.SSL.Cert, pi.dsn.SSL.Key)
-	if err != nil {
-		return err
+	if _, err = os.Stat(pi.dsn.SSL.Cert); err == nil {
+		cert, err := tls.LoadX509KeyPair(pi.dsn.SSL.Cert, pi.dsn.SSL.Key)
+		if err != nil {
+			return err
+		}
+		pi.tlsConfig.Certificates = []tls.Certificate{cert}
 	}
-	pi.tlsConfig.Certificates = []tls.Certificate{cert}
 
 	if _, err = os.Stat(pi.dsn.SSL.RootCert); err == nil {
 		pi.tlsConfig.RootCAs = x509.NewCertPool()
@@ -126,3 +145,27 @@ func (pi *PgIO) sslConfig() (err error) {
 	}
 	return nil
 }
+
+// verifyCA 只校验服务端证书链是否由根证书签发，不校验主机名
+func (pi *PgIO) verifyCA(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("pg: server did not provide a certificate")
+	}
+	var certs = make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	var opts = x509.VerifyOptions{
+		Roots:         pi.tlsConfig.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"github.com/blusewang/pg/internal/helper"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 生成一张只对 localhost 有效的自签名证书，返回服务端证书及根证书文件路径
+func testCert(t *testing.T) (cert tls.Certificate, rootCert string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	dir, err := ioutil.TempDir("", "pg_ssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert = filepath.Join(dir, "root.crt")
+	err = ioutil.WriteFile(rootCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// 模拟服务端：应答 SSLRequest 后完成TLS握手
+func testSSLHandshake(t *testing.T, mode, host string) error {
+	cert, rootCert := testCert(t)
+	defer os.RemoveAll(filepath.Dir(rootCert))
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		var req = make([]byte, 8)
+		if _, err := io.ReadFull(server, req); err != nil {
+			return
+		}
+		if _, err := server.Write([]byte{'S'}); err != nil {
+			return
+		}
+		_ = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+	}()
+
+	dsn, _ := helper.ParseDSN("pg://postgres@" + host + "/postgres")
+	dsn.SSL.Mode = mode
+	dsn.SSL.RootCert = rootCert
+	dsn.SSL.Cert = ""
+	dsn.SSL.Key = ""
+	pi := NewPgIO(dsn)
+	pi.setConn(client)
+	return pi.ssl()
+}
+
+func TestSSLVerifyFull(t *testing.T) {
+	if err := testSSLHandshake(t, helper.SSLModeVerifyFull, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testSSLHandshake(t, helper.SSLModeVerifyFull, "wrong.example.com"); err == nil {
+		t.Fatal("verify-full must reject a certificate with the wrong hostname")
+	}
+}
+
+func TestSSLVerifyCA(t *testing.T) {
+	if err := testSSLHandshake(t, helper.SSLModeVerifyCA, "wrong.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSLPreferFallback(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		var req = make([]byte, 8)
+		if _, err := io.ReadFull(server, req); err != nil {
+			return
+		}
+		_, _ = server.Write([]byte{'N'})
+	}()
+
+	dsn, _ := helper.ParseDSN("pg://postgres@localhost/postgres?sslmode=prefer")
+	pi := NewPgIO(dsn)
+	pi.setConn(client)
+	if err := pi.ssl(); err != nil {
+		t.Fatal(err)
+	}
+	if pi.conn != client {
+		t.Fatal("prefer must continue with the plain connection when the server answers 'N'")
+	}
+
+	dsn.SSL.Mode = helper.SSLModeRequire
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		var req = make([]byte, 8)
+		if _, err := io.ReadFull(server, req); err != nil {
+			return
+		}
+		_, _ = server.Write([]byte{'N'})
+	}()
+	pi = NewPgIO(dsn)
+	pi.setConn(client)
+	if err := pi.ssl(); err == nil {
+		t.Fatal("require must fail when the server answers 'N'")
+	}
+}
+
+func TestSSLAllowUpgrade(t *testing.T) {
+	cert, rootCert := testCert(t)
+	defer os.RemoveAll(filepath.Dir(rootCert))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// 明文连接：拒绝登录
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, server)
+		}()
+		m := testMsg(IdentifiesErrorResponse, "SFATAL", "C28000", `Mno pg_hba.conf entry for host "127.0.0.1", user "postgres", database "postgres", no encryption`, "")
+		_, _ = server.Write(m.encode())
+	}()
+	// 重新连接：同意SSL并完成登录
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var req = make([]byte, 8)
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		if _, err := c.Write([]byte{'S'}); err != nil {
+			return
+		}
+		tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}})
+		var size = make([]byte, 4)
+		if _, err := io.ReadFull(tc, size); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(tc, make([]byte, binary.BigEndian.Uint32(size)-4)); err != nil {
+			return
+		}
+		ok := NewPgMessage(IdentifiesAuth)
+		ok.addInt32(0)
+		for _, m := range []*PgMessage{ok, testReadyForQuery(TransactionStatusIdle)} {
+			if _, err := tc.Write(m.encode()); err != nil {
+				return
+			}
+		}
+		_, _ = io.Copy(ioutil.Discard, tc)
+	}()
+
+	dsn, _ := helper.ParseDSN("pg://postgres@" + ln.Addr().String() + "/postgres?sslmode=allow")
+	dsn.SSL.RootCert = rootCert
+	dsn.SSL.Cert = ""
+	dsn.SSL.Key = ""
+	pi := NewPgIO(dsn)
+	pi.setConn(client)
+	if err := pi.StartUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pi.conn.(*tls.Conn); !ok {
+		t.Fatal("allow must retry with SSL when the server rejects the plain connection")
+	}
+	_ = pi.conn.Close()
+}
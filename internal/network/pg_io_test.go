@@ -0,0 +1,1766 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"github.com/blusewang/pg/internal/helper"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 模拟服务端：丢弃客户端发来的内容，依次回复 responses
+func testPgIO(t *testing.T, responses ...*PgMessage) *PgIO {
+	client, server := net.Pipe()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, server)
+	}()
+	go func() {
+		for _, m := range responses {
+			if _, err := server.Write(m.encode()); err != nil {
+				return
+			}
+		}
+	}()
+	dsn, err := helper.ParseDSN("pg://postgres@localhost/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := NewPgIO(dsn)
+	pi.setConn(client)
+	// 模拟启动时已收到 BackendKeyData
+	pi.backendKeyReceived = true
+	return pi
+}
+
+func testMsg(identifies Identifies, fields ...string) *PgMessage {
+	m := NewPgMessage(identifies)
+	for _, f := range fields {
+		m.addString(f)
+	}
+	return m
+}
+
+func testReadyForQuery(status byte) *PgMessage {
+	m := NewPgMessage(IdentifiesReadyForQuery)
+	m.addByte(status)
+	return m
+}
+
+func TestParameterStatusAfterStartUp(t *testing.T) {
+	pi := testPgIO(t,
+		testMsg(IdentifiesCommandComplete, "SET"),
+		testMsg(IdentifiesParameterStatus, "TimeZone", "Asia/Shanghai"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	var changed string
+	pi.ParameterStatusHandler = func(key, value string) {
+		changed = key + "=" + value
+	}
+	if _, _, _, err := pi.QueryNoArgs("set timezone = 'Asia/Shanghai'"); err != nil {
+		t.Fatal(err)
+	}
+	if changed != "TimeZone=Asia/Shanghai" {
+		t.Fatal(changed)
+	}
+	if pi.ServerConf["TimeZone"] != "Asia/Shanghai" {
+		t.Fatal(pi.ServerConf)
+	}
+	if pi.Location == nil || pi.Location.String() != "Asia/Shanghai" {
+		t.Fatal(pi.Location)
+	}
+}
+
+func TestAuthUnsupported(t *testing.T) {
+	pi := testPgIO(t)
+	defer pi.conn.Close()
+	for _, code := range []int{6, 7, 9, 12} {
+		m := NewPgMessage(IdentifiesAuth)
+		m.addInt32(code)
+		m.Len = uint32(len(m.Content))
+		m.Position = 4
+		if err := pi.auth(*m); err == nil {
+			t.Fatalf("auth code %v must be rejected", code)
+		}
+	}
+}
+
+type testGSS struct {
+	host, service string
+	continued     []byte
+}
+
+func (g *testGSS) GetInitToken(host, service string) ([]byte, error) {
+	g.host, g.service = host, service
+	return []byte("init"), nil
+}
+
+func (g *testGSS) Continue(inToken []byte) (bool, []byte, error) {
+	g.continued = inToken
+	return true, nil, nil
+}
+
+func TestAuthGSS(t *testing.T) {
+	var g = new(testGSS)
+	newGSS = func(user string) (GSS, error) {
+		return g, nil
+	}
+	defer func() {
+		newGSS = nil
+	}()
+
+	cont := NewPgMessage(IdentifiesAuth)
+	cont.addInt32(8)
+	cont.addBytes([]byte("server"))
+	ok := NewPgMessage(IdentifiesAuth)
+	ok.addInt32(0)
+	pi := testPgIO(t, cont, ok)
+	defer pi.conn.Close()
+
+	m := NewPgMessage(IdentifiesAuth)
+	m.addInt32(7)
+	msg := testReceived(m)
+	if err := pi.auth(msg); err != nil {
+		t.Fatal(err)
+	}
+	if g.service != "postgres" || g.host != "localhost" || string(g.continued) != "server" {
+		t.Fatal(g)
+	}
+}
+
+func TestCheckClientEncoding(t *testing.T) {
+	dsn, _ := helper.ParseDSN("pg://postgres@localhost/postgres?client_encoding=latin-1")
+	pi := NewPgIO(dsn)
+	pi.ServerConf["client_encoding"] = "LATIN1"
+	if err := pi.checkClientEncoding(); err != nil {
+		t.Fatal(err)
+	}
+	pi.ServerConf["client_encoding"] = "UTF8"
+	if err := pi.checkClientEncoding(); err == nil {
+		t.Fatal("expect encoding mismatch")
+	}
+	dsn.Parameter["client_encoding"] = "UTF8"
+	pi.ServerConf["client_encoding"] = ""
+	if err := pi.checkClientEncoding(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryNoArgsEmptyQueryResponse(t *testing.T) {
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesEmptyQueryResponse),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	cols, fieldLen, data, err := pi.QueryNoArgs(";")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 0 || len(*fieldLen) != 0 || len(*data) != 0 {
+		t.Fatal(cols, *fieldLen, *data)
+	}
+	if pi.txStatus != TransactionStatusIdle {
+		t.Fatal(pi.txStatus)
+	}
+}
+
+func TestParseExecEmptyQueryResponse(t *testing.T) {
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesBindComplete),
+		NewPgMessage(IdentifiesEmptyQueryResponse),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	_, n, err := pi.ParseExec("", nil)
+	if err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestParseExecOid(t *testing.T) {
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesBindComplete),
+		testMsg(IdentifiesCommandComplete, "INSERT 16390 1"),
+		testReadyForQuery(TransactionStatusIdle),
+		NewPgMessage(IdentifiesBindComplete),
+		testMsg(IdentifiesCommandComplete, "UPDATE 3"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	oid, n, err := pi.ParseExec("", nil)
+	if err != nil || oid != 16390 || n != 1 {
+		t.Fatal(oid, n, err)
+	}
+	oid, n, err = pi.ParseExec("", nil)
+	if err != nil || oid != 0 || n != 3 {
+		t.Fatal(oid, n, err)
+	}
+}
+
+func TestMd5Salted(t *testing.T) {
+	var salt = []byte{0x2a, 0x5f, 0x9c, 0x01}
+	// 与 libpq 的 pg_md5_encrypt 计算结果一致
+	if v := md5Salted("secret", "postgres", salt); v != "678890f850a3fff94c680bfc3666bc0f" {
+		t.Fatal(v)
+	}
+	var pi = NewPgIO(nil)
+	if v := md5Salted("secret", "postgres", salt); v != pi.Md5(pi.Md5("secretpostgres")+string(salt)) {
+		t.Fatal(v)
+	}
+}
+
+func BenchmarkMd5Salted(b *testing.B) {
+	var salt = []byte{0x2a, 0x5f, 0x9c, 0x01}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = md5Salted("secret", "postgres", salt)
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg_unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var socketPath = filepath.Join(dir, ".s.PGSQL.5432")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	pi := NewPgIO(nil)
+	if err = pi.DialUnix(socketPath, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.conn.Close()
+	if pi.conn.RemoteAddr().Network() != "unix" {
+		t.Fatal(pi.conn.RemoteAddr())
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var address = ln.Addr().String()
+	_ = ln.Close()
+
+	dsn, _ := helper.ParseDSN("pg://postgres@localhost/postgres?connect_retries=2&connect_retry_interval=20")
+	pi := NewPgIO(dsn)
+	var start = time.Now()
+	if err = pi.Dial("tcp", address, time.Second); err == nil {
+		t.Fatal("expect connection refused")
+	}
+	// 两次重试分别等待 20ms、40ms
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Fatal(d)
+	}
+
+	dsn.ConnectRetries = 0
+	start = time.Now()
+	if err = pi.Dial("tcp", address, time.Second); err == nil {
+		t.Fatal("expect connection refused")
+	}
+	if d := time.Since(start); d >= 20*time.Millisecond {
+		t.Fatal(d)
+	}
+}
+
+func TestCancelRequestTo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var received = make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var raw = make([]byte, 16)
+		if _, err = io.ReadFull(conn, raw); err == nil {
+			received <- raw
+		}
+	}()
+
+	pi := testPgIO(t)
+	defer pi.conn.Close()
+	pi.serverPid = 1234
+	pi.backendKey = 5678
+	if err = pi.CancelRequestTo("tcp", ln.Addr().String(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case raw := <-received:
+		if binary.BigEndian.Uint32(raw[0:]) != 16 ||
+			binary.BigEndian.Uint32(raw[4:]) != 80877102 ||
+			binary.BigEndian.Uint32(raw[8:]) != 1234 ||
+			binary.BigEndian.Uint32(raw[12:]) != 5678 {
+			t.Fatal(raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancel request not received")
+	}
+}
+
+func testRowDescription(names ...string) *PgMessage {
+	m := NewPgMessage(IdentifiesRowDescription)
+	m.addInt16(len(names))
+	for _, name := range names {
+		m.addString(name)
+		m.addInt32(0)  // table oid
+		m.addInt16(0)  // attribute number
+		m.addInt32(25) // text
+		m.addInt16(-1)
+		m.addInt32(-1)
+		m.addInt16(0)
+	}
+	return m
+}
+
+func testDataRow(values ...string) *PgMessage {
+	m := NewPgMessage(IdentifiesDataRow)
+	m.addInt16(len(values))
+	for _, v := range values {
+		m.addInt32(len(v))
+		m.addBytes([]byte(v))
+	}
+	return m
+}
+
+func TestQueryNoArgsMulti(t *testing.T) {
+	pi := testPgIO(t,
+		testRowDescription("a"),
+		testDataRow("1"),
+		testMsg(IdentifiesCommandComplete, "SELECT 1"),
+		testMsg(IdentifiesCommandComplete, "INSERT 0 1"),
+		testRowDescription("b", "c"),
+		testDataRow("2", "3"),
+		testDataRow("4", "5"),
+		testMsg(IdentifiesCommandComplete, "SELECT 2"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	sets, err := pi.QueryNoArgsMulti("select 1 a; insert into t values (1); select 2 b, 3 c union select 4, 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 {
+		t.Fatal(len(sets))
+	}
+	if sets[0].Columns[0].Name != "a" || len(*sets[0].Rows) != 1 {
+		t.Fatal(sets[0])
+	}
+	if len(sets[1].Columns) != 2 || len(*sets[1].Rows) != 2 || string((*sets[1].Rows)[1][1]) != "5" {
+		t.Fatal(sets[1])
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func TestSendCoalescesUntilSync(t *testing.T) {
+	pi := testPgIO(t)
+	defer pi.conn.Close()
+	var conn = &countingConn{Conn: pi.conn}
+	pi.setConn(conn)
+
+	if err := pi.send(NewPgMessage(IdentifiesBind), NewPgMessage(IdentifiesExecute)); err != nil {
+		t.Fatal(err)
+	}
+	if conn.writes != 0 {
+		t.Fatal("messages before Sync must stay buffered")
+	}
+	if err := pi.send(NewPgMessage(IdentifiesSync)); err != nil {
+		t.Fatal(err)
+	}
+	if conn.writes != 1 {
+		t.Fatal(conn.writes)
+	}
+}
+
+func TestQueryNoArgsExec(t *testing.T) {
+	pi := testPgIO(t,
+		testMsg(IdentifiesCommandComplete, "INSERT 0 5"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	tag, n, err := pi.QueryNoArgsExec("insert into t select generate_series(1, 5)")
+	if err != nil || tag != "INSERT 0 5" || n != 5 {
+		t.Fatal(tag, n, err)
+	}
+}
+
+func TestQueryNoArgsMultiExec(t *testing.T) {
+	pi := testPgIO(t,
+		testMsg(IdentifiesCommandComplete, "INSERT 0 1"),
+		testMsg(IdentifiesCommandComplete, "INSERT 0 2"),
+		testMsg(IdentifiesCommandComplete, "UPDATE 3"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	n, err := pi.QueryNoArgsMultiExec("insert into t values (1); insert into t values (2), (3); update t set id = id + 1")
+	if err != nil || n != 6 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	pi := testPgIO(t)
+	if err := pi.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	_ = pi.conn.Close()
+	if err := pi.HealthCheck(); err != driver.ErrBadConn {
+		t.Fatal(err)
+	}
+
+	pi = testPgIO(t, testMsg(IdentifiesErrorResponse, "SFATAL", "C57P01", "Mterminating connection due to administrator command", ""))
+	defer pi.conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := pi.HealthCheck(); err != driver.ErrBadConn {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForNotification(t *testing.T) {
+	notify := NewPgMessage(IdentifiesNotificationResponse)
+	notify.addInt32(4321)
+	notify.addString("jobs")
+	notify.addString("42")
+	pi := testPgIO(t, testMsg(IdentifiesParameterStatus, "TimeZone", "UTC"), notify)
+	defer pi.conn.Close()
+
+	n, err := pi.WaitForNotification(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.PID != 4321 || n.Channel != "jobs" || n.Payload != "42" {
+		t.Fatal(n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = pi.WaitForNotification(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if pi.IOError != nil {
+		t.Fatal(pi.IOError)
+	}
+
+	// 没有截止时间的 ctx 被取消时同样及时返回
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err = pi.WaitForNotification(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if pi.IOError != nil {
+		t.Fatal(pi.IOError)
+	}
+}
+
+func TestSendQueryStream(t *testing.T) {
+	pi := testPgIO(t,
+		testRowDescription("n"),
+		testDataRow("1"),
+		testDataRow("2"),
+		testDataRow("3"),
+		testMsg(IdentifiesCommandComplete, "SELECT 3"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	var got []string
+	err := pi.SendQueryStream(context.Background(), "select generate_series(1, 3) n", func(cols []PgColumn, row [][]byte) error {
+		if cols[0].Name != "n" {
+			t.Fatal(cols)
+		}
+		got = append(got, string(row[0]))
+		return nil
+	})
+	if err != nil || len(got) != 3 || got[2] != "3" {
+		t.Fatal(got, err)
+	}
+}
+
+func TestSendQueryStreamStop(t *testing.T) {
+	pi := testPgIO(t,
+		testRowDescription("n"),
+		testDataRow("1"),
+		testDataRow("2"),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C57014", "Mcanceling statement due to user request", ""),
+		testReadyForQuery(TransactionStatusIdle),
+		testRowDescription("n"),
+		testDataRow("ok"),
+		testMsg(IdentifiesCommandComplete, "SELECT 1"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+	pi.dsn.Host = "127.0.0.1"
+	pi.dsn.Port = "1"
+
+	var stop = io.ErrShortBuffer
+	var calls int
+	err := pi.SendQueryStream(context.Background(), "select generate_series(1, 1000000) n", func(cols []PgColumn, row [][]byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatal(calls, err)
+	}
+	// 剩余的消息已读完，连接可以继续使用
+	_, _, data, err := pi.QueryNoArgs("select 'ok'")
+	if err != nil || string((*data)[0][0]) != "ok" {
+		t.Fatal(err)
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	params := NewPgMessage(IdentifiesParameterDescription)
+	params.addInt16(1)
+	params.addInt32(23)
+	noParams := NewPgMessage(IdentifiesParameterDescription)
+	noParams.addInt16(0)
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesParseComplete),
+		params,
+		testRowDescription("a"),
+		testReadyForQuery(TransactionStatusIdle),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C42P01", `Mrelation "missing" does not exist`, ""),
+		testReadyForQuery(TransactionStatusIdle),
+		NewPgMessage(IdentifiesParseComplete),
+		noParams,
+		NewPgMessage(IdentifiesNoData),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	results, err := pi.ParseBatch([]BatchEntry{
+		{Name: "s1", SQL: "select a from t where id = $1"},
+		{Name: "s2", SQL: "select * from missing"},
+		{Name: "s3", SQL: "vacuum"},
+	})
+	if err != nil || len(results) != 3 {
+		t.Fatal(results, err)
+	}
+	if results[0].Err != nil || len(results[0].Columns) != 1 || len(results[0].ParameterTypes) != 1 || results[0].ParameterTypes[0] != 23 {
+		t.Fatal(results[0])
+	}
+	if e, ok := results[1].Err.(*PgError); !ok || e.SQLState != "42P01" {
+		t.Fatal(results[1].Err)
+	}
+	if results[2].Err != nil || len(results[2].Columns) != 0 {
+		t.Fatal(results[2])
+	}
+}
+
+func TestParseQueryContextCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// 服务端收到 CancelRequest 后才返回查询结果
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, server)
+	}()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, c)
+		for _, m := range []*PgMessage{
+			testMsg(IdentifiesErrorResponse, "SERROR", "C57014", "Mcanceling statement due to user request", ""),
+			testReadyForQuery(TransactionStatusIdle),
+		} {
+			_, _ = server.Write(m.encode())
+		}
+	}()
+	dsn, err := helper.ParseDSN("pg://postgres@" + ln.Addr().String() + "/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := NewPgIO(dsn)
+	pi.setConn(client)
+	pi.backendKeyReceived = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, data, err := pi.ParseQueryContext(ctx, "s1", nil)
+	if e, ok := err.(*PgError); !ok || e.SQLState != "57014" || len(*data) != 0 {
+		t.Fatal(err)
+	}
+	// 发出过取消请求的连接不再复用
+	if pi.IOError != ErrCancelPending {
+		t.Fatal(pi.IOError)
+	}
+
+	_, _, err = pi.ParseQueryContext(ctx, "s1", nil)
+	if err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+// slowConn 每次写入前等待 delay，模拟接收缓冲区已满的服务端
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var canceled = make(chan []byte, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		raw, _ := ioutil.ReadAll(c)
+		canceled <- raw
+	}()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, server)
+	}()
+	dsn, err := helper.ParseDSN("pg://postgres@" + ln.Addr().String() + "/postgres?write_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := NewPgIO(dsn)
+	pi.backendKeyReceived = true
+	pi.SetWriteTimeout(20 * time.Millisecond)
+	pi.setConn(slowConn{Conn: client, delay: 5 * time.Millisecond})
+	if err = pi.send(NewPgMessage(IdentifiesSync)); err != nil {
+		t.Fatal(err)
+	}
+
+	pi.setConn(slowConn{Conn: client, delay: 50 * time.Millisecond})
+	err = pi.send(NewPgMessage(IdentifiesSync))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+	if pi.IOError != driver.ErrBadConn {
+		t.Fatal(pi.IOError)
+	}
+	select {
+	case raw := <-canceled:
+		if len(raw) != 16 || binary.BigEndian.Uint32(raw[4:]) != 80877102 {
+			t.Fatal(raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no CancelRequest after the write timed out")
+	}
+}
+
+func TestRecoverFromFailedTransaction(t *testing.T) {
+	pi := testPgIO(t,
+		testMsg(IdentifiesCommandComplete, "ROLLBACK"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	// 不在失败的事务中时不发送任何消息
+	pi.txStatus = TransactionStatusIdleInTransaction
+	if err := pi.RecoverFromFailedTransaction(context.Background()); err != nil || pi.txStatus != TransactionStatusIdleInTransaction {
+		t.Fatal(err, pi.txStatus)
+	}
+	pi.txStatus = TransactionStatusInFailedTransaction
+	if err := pi.RecoverFromFailedTransaction(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if pi.IsInTransaction() {
+		t.Fatal(pi.txStatus)
+	}
+}
+
+func TestParseAndExecBatch(t *testing.T) {
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesParseComplete),
+		NewPgMessage(IdentifiesBindComplete),
+		testMsg(IdentifiesCommandComplete, "INSERT 0 1"),
+		NewPgMessage(IdentifiesBindComplete),
+		testMsg(IdentifiesCommandComplete, "UPDATE 3"),
+		testReadyForQuery(TransactionStatusIdleInTransaction),
+		NewPgMessage(IdentifiesParseComplete),
+		NewPgMessage(IdentifiesBindComplete),
+		testMsg(IdentifiesCommandComplete, "INSERT 0 1"),
+		NewPgMessage(IdentifiesParseComplete),
+		NewPgMessage(IdentifiesBindComplete),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C23505", "Mduplicate key value violates unique constraint", ""),
+		testReadyForQuery(TransactionStatusInFailedTransaction),
+	)
+	defer pi.conn.Close()
+
+	counts, err := pi.ParseAndExecBatch(context.Background(), []BatchStmt{
+		{SQL: "insert into audit(msg) values($1)", Args: []interface{}{"pay"}},
+		{Name: "s_pay", Args: []interface{}{int64(7)}},
+	})
+	if err != nil || len(counts) != 2 || counts[0] != 1 || counts[1] != 3 {
+		t.Fatal(counts, err)
+	}
+
+	counts, err = pi.ParseAndExecBatch(context.Background(), []BatchStmt{
+		{SQL: "insert into audit(msg) values($1)", Args: []interface{}{"refund"}},
+		{SQL: "insert into orders(id) values($1)", Args: []interface{}{int64(7)}},
+		{SQL: "update balance set n = n + 1"},
+	})
+	if e, ok := err.(*BatchError); !ok || e.Index != 1 || e.Err.(*PgError).SQLState != "23505" {
+		t.Fatal(err)
+	}
+	if len(counts) != 3 || counts[0] != 1 || counts[1] != -1 || counts[2] != -1 {
+		t.Fatal(counts)
+	}
+	// 显式事务中出错，整个事务只能回滚
+	if pi.txStatus != TransactionStatusInFailedTransaction {
+		t.Fatal(pi.txStatus)
+	}
+}
+
+func TestClosePortal(t *testing.T) {
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesCloseComplete),
+		testReadyForQuery(TransactionStatusIdleInTransaction),
+	)
+	defer pi.conn.Close()
+
+	if err := pi.ClosePortal("p1"); err != nil {
+		t.Fatal(err)
+	}
+	if pi.txStatus != TransactionStatusIdleInTransaction {
+		t.Fatal(pi.txStatus)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	params := NewPgMessage(IdentifiesParameterDescription)
+	params.addInt16(2)
+	params.addInt32(23)
+	params.addInt32(25)
+	pi := testPgIO(t,
+		params,
+		testRowDescription("id"),
+		testReadyForQuery(TransactionStatusIdle),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C26000", `Mprepared statement "missing" does not exist`, ""),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	cols, parameters, err := pi.Describe("s1")
+	if err != nil || len(cols) != 1 || len(parameters) != 2 || parameters[1] != 25 {
+		t.Fatal(cols, parameters, err)
+	}
+	if _, _, err = pi.Describe("missing"); err != ErrStatementNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDuplicateStatement(t *testing.T) {
+	var duplicate = testMsg(IdentifiesErrorResponse, "SERROR", "C42P05", `Mprepared statement "s1" already exists`, "")
+	pi := testPgIO(t,
+		duplicate,
+		testReadyForQuery(TransactionStatusIdle),
+		NewPgMessage(IdentifiesCloseComplete),
+		testReadyForQuery(TransactionStatusIdle),
+		NewPgMessage(IdentifiesParseComplete),
+		testParameterDescription(23),
+		testRowDescription("id"),
+		testReadyForQuery(TransactionStatusIdle),
+		// 重试后仍然重复，不再重试
+		duplicate,
+		testReadyForQuery(TransactionStatusIdle),
+		NewPgMessage(IdentifiesCloseComplete),
+		testReadyForQuery(TransactionStatusIdle),
+		duplicate,
+		testReadyForQuery(TransactionStatusIdle),
+		// 事务已失败，不重试
+		duplicate,
+		testReadyForQuery(TransactionStatusInFailedTransaction),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	cols, parameters, err := pi.Parse("s1", "select $1::int4 as id")
+	if err != nil || len(cols) != 1 || len(parameters) != 1 {
+		t.Fatal(cols, parameters, err)
+	}
+	if _, _, err = pi.Parse("s1", "select 1"); err == nil || err.(*PgError).SQLState != "42P05" {
+		t.Fatal(err)
+	}
+	if _, _, err = pi.Parse("s1", "select 1"); err == nil || pi.txStatus != TransactionStatusInFailedTransaction {
+		t.Fatal(err)
+	}
+	// 剩下的应答未被读取
+	ms, err := pi.receivePgMsg(IdentifiesReadyForQuery)
+	if err != nil || len(ms) != 1 || ms[0].byte() != byte(TransactionStatusIdle) {
+		t.Fatal(ms, err)
+	}
+}
+
+func TestStartupReplication(t *testing.T) {
+	for mode, want := range map[string]map[string]string{
+		"database": {"replication": "database", "user": "postgres", "database": "postgres", "application_name": "app", "client_encoding": "UTF8"},
+		"true":     {"replication": "true", "user": "postgres", "application_name": "app", "client_encoding": "UTF8"},
+	} {
+		client, server := net.Pipe()
+		var params = make(chan map[string]string, 1)
+		go func() {
+			var size = make([]byte, 4)
+			if _, err := io.ReadFull(server, size); err != nil {
+				return
+			}
+			var body = make([]byte, binary.BigEndian.Uint32(size)-4)
+			if _, err := io.ReadFull(server, body); err != nil {
+				return
+			}
+			var m = make(map[string]string)
+			var fields = bytes.Split(bytes.TrimRight(body[4:], "\x00"), []byte{0})
+			for i := 0; i+1 < len(fields); i += 2 {
+				m[string(fields[i])] = string(fields[i+1])
+			}
+			params <- m
+			ok := NewPgMessage(IdentifiesAuth)
+			ok.addInt32(0)
+			_, _ = server.Write(ok.encode())
+			_, _ = server.Write(testReadyForQuery(TransactionStatusIdle).encode())
+		}()
+		dsn, err := helper.ParseDSN("pg://postgres@localhost/postgres?sslmode=disable&application_name=app&search_path=app&TimeZone=UTC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pi := NewPgIO(dsn)
+		pi.setConn(client)
+		if err = pi.StartupReplication(mode); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-params; !reflect.DeepEqual(got, want) {
+			t.Fatal(mode, got)
+		}
+		_ = client.Close()
+	}
+
+	pi := NewPgIO(nil)
+	if err := pi.StartupReplication("physical"); err == nil {
+		t.Fatal("invalid replication mode")
+	}
+}
+
+func TestEmptyQuery(t *testing.T) {
+	// 没有模拟服务端：任何读写都会出错
+	pi := NewPgIO(nil)
+	cols, fieldLen, data, err := pi.QueryNoArgs(" \n\t")
+	if err != nil || cols != nil || len(*fieldLen) != 0 || len(*data) != 0 {
+		t.Fatal(cols, err)
+	}
+	if cols, parameters, err := pi.Parse("s1", ""); err != nil || cols != nil || parameters != nil {
+		t.Fatal(cols, parameters, err)
+	}
+}
+
+func TestNoticeHandler(t *testing.T) {
+	pi := testPgIO(t,
+		testMsg(IdentifiesNoticeResponse, "SNOTICE", "C42P07", `Mrelation "t" already exists, skipping`, ""),
+		testMsg(IdentifiesCommandComplete, "CREATE TABLE"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	var notices []*PgError
+	pi.SetNoticeHandler(func(e *PgError) {
+		notices = append(notices, e)
+	})
+	if _, _, err := pi.QueryNoArgsExec("create table if not exists t ()"); err != nil {
+		t.Fatal(err)
+	}
+	if len(notices) != 1 || notices[0].Severity != "NOTICE" || notices[0].SQLState != "42P07" {
+		t.Fatal(notices)
+	}
+}
+
+func TestNoticeMidStream(t *testing.T) {
+	var notice = testMsg(IdentifiesNoticeResponse, "SNOTICE", "C00000", "Mrow 1", "")
+	pi := testPgIO(t,
+		testRowDescription("a"),
+		testDataRow("1"),
+		notice,
+		testDataRow("2"),
+		notice,
+		testMsg(IdentifiesCommandComplete, "SELECT 2"),
+		testReadyForQuery(TransactionStatusIdle),
+		testRowDescription("a"),
+		testDataRow("1"),
+		notice,
+		testMsg(IdentifiesCommandComplete, "SELECT 1"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	var notices int
+	pi.SetNoticeHandler(func(e *PgError) {
+		notices++
+	})
+	cols, _, data, err := pi.QueryNoArgs("select a from f()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 1 || len(*data) != 2 || string((*data)[1][0]) != "2" {
+		t.Fatal(cols, *data)
+	}
+	sets, err := pi.QueryNoArgsMulti("select a from f()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 || len(*sets[0].Rows) != 1 {
+		t.Fatal(sets)
+	}
+	if notices != 3 {
+		t.Fatal(notices)
+	}
+}
+
+func TestStartUpContextStall(t *testing.T) {
+	// 认证通过后服务端不再发送任何消息
+	ok := NewPgMessage(IdentifiesAuth)
+	ok.addInt32(0)
+	pi := testPgIO(t, ok)
+	defer pi.conn.Close()
+	pi.dsn.SSL.Mode = helper.SSLModeDisable
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var start = time.Now()
+	if err := pi.StartUpContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal(d)
+	}
+	if pi.IOError == nil {
+		t.Fatal("the connection must be unusable after an interrupted startup")
+	}
+}
+
+func TestQuoteChannel(t *testing.T) {
+	for name, want := range map[string]string{
+		"orders":                `"orders"`,
+		"Orders":                `"Orders"`,
+		`say "hi"`:              `"say ""hi"""`,
+		"订单":                    `"订单"`,
+		"select":                `"select"`,
+		"a\x00b":                "",
+		"line\nbreak":           "",
+		"\xff":                  "",
+		"":                      "",
+		strings.Repeat("c", 64): "",
+	} {
+		got, err := quoteChannel(name)
+		if got != want || (err == nil) != (want != "") {
+			t.Fatal(name, got, err)
+		}
+	}
+}
+
+func TestListenMulti(t *testing.T) {
+	pi := testPgIO(t,
+		testMsg(IdentifiesCommandComplete, "LISTEN"),
+		testMsg(IdentifiesCommandComplete, "LISTEN"),
+		testReadyForQuery(TransactionStatusIdle),
+		testMsg(IdentifiesCommandComplete, "UNLISTEN"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	if err := pi.ListenMulti(context.Background(), "orders", "Refunds"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.ListenMulti(context.Background(), "bad\nname"); err == nil {
+		t.Fatal("control characters must be rejected")
+	}
+	if err := pi.UnlistenAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveAsync(t *testing.T) {
+	notify := NewPgMessage(IdentifiesNotificationResponse)
+	notify.addInt32(42)
+	notify.addString("orders")
+	notify.addString("7")
+	var async []byte
+	for _, m := range []*PgMessage{
+		notify,
+		testMsg(IdentifiesParameterStatus, "application_name", "worker"),
+		testMsg(IdentifiesCommandComplete, "SELECT 0"),
+		testReadyForQuery(TransactionStatusIdle),
+	} {
+		async = append(async, m.encode()...)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = server.Write(async)
+		_, _ = io.Copy(ioutil.Discard, server)
+	}()
+	pi := NewPgIO(nil)
+	pi.setConn(client)
+	var notifications []*Notification
+	pi.NotificationHandler = func(n *Notification) {
+		notifications = append(notifications, n)
+	}
+	// 空闲期间到达的消息已在缓冲区中
+	if _, err := pi.reader.Peek(len(async)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.ReceiveAsync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 1 || notifications[0].Channel != "orders" || notifications[0].Payload != "7" {
+		t.Fatal(notifications)
+	}
+	if pi.ServerConf["application_name"] != "worker" {
+		t.Fatal(pi.ServerConf)
+	}
+	// 之后的消息属于查询的响应，保持不动
+	if b, _ := pi.reader.Peek(1); Identifies(b[0]) != IdentifiesCommandComplete {
+		t.Fatal(string(b))
+	}
+}
+
+func TestSync(t *testing.T) {
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesParseComplete),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C42P01", `Mrelation "missing" does not exist`, ""),
+		testReadyForQuery(TransactionStatusIdle),
+		testReadyForQuery(TransactionStatusIdleInTransaction),
+	)
+	defer pi.conn.Close()
+
+	if e, ok := pi.Sync().(*PgError); !ok || e.SQLState != "42P01" {
+		t.Fatal(e)
+	}
+	if err := pi.Sync(); err != nil || pi.txStatus != TransactionStatusIdleInTransaction {
+		t.Fatal(err, pi.txStatus)
+	}
+}
+
+func TestReadyForQueryStatus(t *testing.T) {
+	pi := testPgIO(t,
+		testMsg(IdentifiesNoticeResponse, "SWARNING", "C25001", "Mthere is already a transaction in progress", ""),
+		testMsg(IdentifiesParameterStatus, "TimeZone", "UTC"),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C22012", "Mdivision by zero", ""),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C25P02", "Mcurrent transaction is aborted", ""),
+		testReadyForQuery(TransactionStatusInFailedTransaction),
+	)
+	defer pi.conn.Close()
+
+	var notices int
+	pi.SetNoticeHandler(func(*PgError) {
+		notices++
+	})
+	status, err := pi.ReadyForQueryStatus(context.Background())
+	if e, ok := err.(*PgError); !ok || e.SQLState != "22012" {
+		t.Fatal(err)
+	}
+	if status != TransactionStatusInFailedTransaction || notices != 1 || pi.ServerConf["TimeZone"] != "UTC" {
+		t.Fatal(status, notices, pi.ServerConf)
+	}
+
+	// 没有消息时按 ctx 返回，ReadyForQuery 尚未读到，连接作废
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = pi.ReadyForQueryStatus(ctx); err != context.DeadlineExceeded || pi.IOError != context.DeadlineExceeded {
+		t.Fatal(err, pi.IOError)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	// 只回复第一个查询
+	pi := testPgIO(t,
+		testMsg(IdentifiesCommandComplete, "SELECT 0"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	pi.SetReadTimeout(20 * time.Millisecond)
+	if _, _, err := pi.QueryNoArgsExec("select"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := pi.QueryNoArgsExec("select pg_sleep(10)")
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+	if pi.IOError == nil {
+		t.Fatal("the connection must be unusable after a read timeout")
+	}
+}
+
+func TestReadTimeoutKeepsDeadline(t *testing.T) {
+	pi := testPgIO(t,
+		testMsg(IdentifiesCommandComplete, "SELECT 0"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	// read_timeout 较长时，由 ctx 得到的截止时间仍然生效，且不会被单次读取清除
+	pi.SetReadTimeout(time.Minute)
+	if err := pi.setDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pi.QueryNoArgsExec("select"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, _, err := pi.QueryNoArgsExec("select pg_sleep(10)")
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestDeprecatedWriteTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, server)
+	}()
+	dsn, err := helper.ParseDSN("pg://postgres@localhost/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := NewPgIO(dsn)
+	pi.WriteTimeout = 20 * time.Millisecond
+	pi.setConn(slowConn{Conn: client, delay: 50 * time.Millisecond})
+	err = pi.send(NewPgMessage(IdentifiesSync))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelRequestContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pi := NewPgIO(&helper.DataSourceName{})
+	pi.backendKeyReceived = true
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = pi.CancelRequestContext(ctx, "tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err = pi.CancelRequestContext(ctx, "tcp", ln.Addr().String()); err == nil {
+		t.Fatal("a canceled context must stop the dial")
+	}
+}
+
+// 同一连接反复执行查询时，每次 WatchCancel 的状态相互独立：已结束的调用不会再发出取消请求
+func TestWatchCancelReuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted = make(chan struct{}, 100)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+			accepted <- struct{}{}
+		}
+	}()
+	dsn, err := helper.ParseDSN("pg://postgres@" + ln.Addr().String() + "/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := NewPgIO(dsn)
+	pi.backendKeyReceived = true
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		pi.WatchCancel(ctx)()
+		cancel()
+	}
+	if pi.IOError != nil {
+		t.Fatal(pi.IOError)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("a finished WatchCancel sent a CancelRequest")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 查询结束与取消重叠：done 不等取消请求发出就被调用。
+	// 取消请求要么没有发出，要么 done 等它发完并把连接标记为不可用
+	for i := 0; i < 20; i++ {
+		pi.IOError = nil
+		ctx, cancel := context.WithCancel(context.Background())
+		done := pi.WatchCancel(ctx)
+		cancel()
+		done()
+		if pi.IOError == nil {
+			select {
+			case <-accepted:
+				t.Fatal("a CancelRequest was sent but the connection is still in use")
+			case <-time.After(50 * time.Millisecond):
+			}
+			continue
+		}
+		if pi.IOError != ErrCancelPending {
+			t.Fatal(pi.IOError)
+		}
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+			t.Fatal("done returned before the CancelRequest was sent")
+		}
+	}
+}
+
+func TestQueryNoArgsErrorMidStream(t *testing.T) {
+	pi := testPgIO(t,
+		testRowDescription("n"),
+		testDataRow("1"),
+		testDataRow("2"),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C22012", "Mdivision by zero", ""),
+		testReadyForQuery(TransactionStatusIdle),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C42601", "Msyntax error", ""),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	_, fieldLen, data, err := pi.QueryNoArgs("select 1 / (2 - n) from generate_series(0, 3) n")
+	if e, ok := err.(*PgError); !ok || e.SQLState != "22012" {
+		t.Fatal(err)
+	}
+	if len(*fieldLen) != 0 || len(*data) != 0 {
+		t.Fatal(*data)
+	}
+	// 错误之后连接仍停在 ReadyForQuery，可继续使用
+	_, _, data, err = pi.QueryNoArgs("selec")
+	if e, ok := err.(*PgError); !ok || e.SQLState != "42601" || len(*data) != 0 {
+		t.Fatal(err)
+	}
+	if pi.IOError != nil {
+		t.Fatal(pi.IOError)
+	}
+}
+
+func TestCopyFrom(t *testing.T) {
+	copyIn := NewPgMessage(IdentifiesCopyInResponse)
+	copyIn.addByte(0)
+	copyIn.addInt16(0)
+	pi := testPgIO(t,
+		copyIn,
+		testMsg(IdentifiesCommandComplete, "COPY 2"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	var buf = AppendCopyText(nil, []interface{}{int64(1), "a\tb"})
+	buf = AppendCopyText(buf, []interface{}{int64(2), nil})
+	n, err := pi.CopyFrom("copy t (id, name) from stdin", bytes.NewReader(buf))
+	if err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestAppendCopyText(t *testing.T) {
+	var buf = AppendCopyText(nil, []interface{}{int64(1), "a\\b\nc\td\re", nil, 1.5})
+	if string(buf) != "1\ta\\\\b\\nc\\td\\re\t\\N\t1.5\n" {
+		t.Fatalf("%q", buf)
+	}
+}
+
+func TestVerifySession(t *testing.T) {
+	var result = func(database, user string) []*PgMessage {
+		return []*PgMessage{
+			testRowDescription("current_database", "current_user"),
+			testDataRow(database, user),
+			testMsg(IdentifiesCommandComplete, "SELECT 1"),
+			testReadyForQuery(TransactionStatusIdle),
+		}
+	}
+	pi := testPgIO(t, result("postgres", "postgres")...)
+	pi.dsn.RequireDatabase = true
+	pi.dsn.RequireUser = true
+	if err := pi.verifySession(); err != nil {
+		t.Fatal(err)
+	}
+	_ = pi.conn.Close()
+
+	pi = testPgIO(t, result("other", "postgres")...)
+	pi.dsn.RequireDatabase = true
+	if err := pi.verifySession(); err != ErrWrongDatabase {
+		t.Fatal(err)
+	}
+	_ = pi.conn.Close()
+
+	pi = testPgIO(t, result("postgres", "admin")...)
+	pi.dsn.RequireUser = true
+	if err := pi.verifySession(); err != ErrWrongUser {
+		t.Fatal(err)
+	}
+	_ = pi.conn.Close()
+}
+
+func TestParseQueryFetch(t *testing.T) {
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesBindComplete),
+		testDataRow("1"),
+		testDataRow("2"),
+		NewPgMessage(IdentifiesPortalSuspended),
+		testDataRow("3"),
+		testMsg(IdentifiesCommandComplete, "SELECT 3"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+
+	_, data, suspended, err := pi.ParseQueryFetchContext(context.Background(), "", "", nil, nil, 2)
+	if err != nil || !suspended || len(*data) != 2 {
+		t.Fatal(err, suspended, *data)
+	}
+	// 门户挂起期间不能开始新的请求，连接仍然可用
+	if _, _, err = pi.ParseQuery("", nil); err != ErrPortalSuspended || pi.IOError != nil {
+		t.Fatal(err, pi.IOError)
+	}
+	_, data, suspended, err = pi.FetchPortal("", 2)
+	if err != nil || suspended || len(*data) != 1 || string((*data)[0][0]) != "3" {
+		t.Fatal(err, suspended, *data)
+	}
+	if pi.txStatus != TransactionStatusIdle || pi.portalSuspended {
+		t.Fatal(pi.txStatus, pi.portalSuspended)
+	}
+	if _, _, _, err = pi.FetchPortal("", 2); err == nil {
+		t.Fatal("fetching a finished portal must fail")
+	}
+
+	// 设置了处理函数时，新请求之前先读完挂起的门户
+	pi = testPgIO(t,
+		NewPgMessage(IdentifiesBindComplete),
+		testDataRow("1"),
+		NewPgMessage(IdentifiesPortalSuspended),
+		testDataRow("2"),
+		testMsg(IdentifiesCommandComplete, "SELECT 2"),
+		testReadyForQuery(TransactionStatusIdle),
+		testMsg(IdentifiesCommandComplete, "SET"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+	if _, _, suspended, err = pi.ParseQueryFetchContext(context.Background(), "", "", nil, nil, 1); err != nil || !suspended {
+		t.Fatal(err, suspended)
+	}
+	var rest *[][][]byte
+	pi.SetPortalDrain(func() (err error) {
+		_, rest, _, err = pi.FetchPortal("", 0)
+		return
+	})
+	if _, _, err = pi.QueryNoArgsExec("set x = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if rest == nil || len(*rest) != 1 || string((*rest)[0][0]) != "2" || pi.portalSuspended || pi.drainPortal != nil {
+		t.Fatal(rest, pi.portalSuspended)
+	}
+
+	pi = testPgIO(t,
+		NewPgMessage(IdentifiesBindComplete),
+		testDataRow("1"),
+		NewPgMessage(IdentifiesPortalSuspended),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C22012", "Mdivision by zero", ""),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+	defer pi.conn.Close()
+	if _, _, _, err = pi.ParseQueryFetchContext(context.Background(), "", "", nil, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	_, data, suspended, err = pi.FetchPortal("", 1)
+	if e, ok := err.(*PgError); !ok || e.SQLState != "22012" {
+		t.Fatal(err)
+	}
+	if suspended || len(*data) != 0 || pi.IOError != nil || pi.portalSuspended {
+		t.Fatal(*data, pi.IOError)
+	}
+}
+
+func testParameterDescription(oids ...int) *PgMessage {
+	m := NewPgMessage(IdentifiesParameterDescription)
+	m.addInt16(len(oids))
+	for _, oid := range oids {
+		m.addInt32(oid)
+	}
+	return m
+}
+
+// testRecordingPgIO 记录客户端发出的消息类型，收到 n 条后依次返回 responses。
+// 客户端关闭连接后，记录的消息类型从返回的通道中取得
+func testRecordingPgIO(n int, responses ...*PgMessage) (*PgIO, <-chan []Identifies) {
+	client, server := net.Pipe()
+	var sent = make(chan []Identifies, 1)
+	go func() {
+		defer server.Close()
+		var ids []Identifies
+		var r = bufio.NewReader(server)
+		for {
+			id, err := r.ReadByte()
+			if err != nil {
+				sent <- ids
+				return
+			}
+			var l [4]byte
+			if _, err = io.ReadFull(r, l[:]); err != nil {
+				sent <- ids
+				return
+			}
+			if _, err = io.CopyN(ioutil.Discard, r, int64(binary.BigEndian.Uint32(l[:])-4)); err != nil {
+				sent <- ids
+				return
+			}
+			ids = append(ids, Identifies(id))
+			if len(ids) == n {
+				for _, m := range responses {
+					_, _ = server.Write(m.encode())
+				}
+			}
+		}
+	}()
+	pi := NewPgIO(nil)
+	pi.setConn(client)
+	return pi, sent
+}
+
+func TestCloseParseAsync(t *testing.T) {
+	pi, sent := testRecordingPgIO(5,
+		NewPgMessage(IdentifiesCloseComplete),
+		testReadyForQuery(TransactionStatusIdle),
+		NewPgMessage(IdentifiesParseComplete),
+		testParameterDescription(),
+		NewPgMessage(IdentifiesNoData),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+
+	if err := pi.CloseParseAsync("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.CloseParseAsync("s\x001"); err != ErrNulInString {
+		t.Fatal(err)
+	}
+	if _, _, err := pi.Parse("s1", "select 1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(pi.pendingCloses) != 0 {
+		t.Fatal(len(pi.pendingCloses))
+	}
+	_ = pi.conn.Close()
+	ids := <-sent
+	if !reflect.DeepEqual(ids, []Identifies{IdentifiesClose, IdentifiesSync, IdentifiesParse, IdentifiesDescribe, IdentifiesSync}) {
+		t.Fatalf("%q", ids)
+	}
+}
+
+func TestCloseParseAsyncAnyRequest(t *testing.T) {
+	pi, sent := testRecordingPgIO(3,
+		NewPgMessage(IdentifiesCloseComplete),
+		testReadyForQuery(TransactionStatusIdle),
+		testMsg(IdentifiesCommandComplete, "SELECT 0"),
+		testReadyForQuery(TransactionStatusIdle),
+	)
+
+	// 简单查询同样带上暂存的 Close
+	if err := pi.CloseParseAsync("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pi.QueryNoArgsExec("select"); err != nil {
+		t.Fatal(err)
+	}
+	if len(pi.pendingCloses) != 0 {
+		t.Fatal(len(pi.pendingCloses))
+	}
+
+	// 扩展查询未以 Sync 结束时不插入
+	if err := pi.send(newBind("p1", "s2", nil, nil), NewPgMessage(IdentifiesFlush)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.CloseParseAsync("s1"); err != nil {
+		t.Fatal(err)
+	}
+	rExec := NewPgMessage(IdentifiesExecute)
+	rExec.addString("p1")
+	rExec.addInt32(1)
+	if err := pi.send(rExec, NewPgMessage(IdentifiesSync)); err != nil {
+		t.Fatal(err)
+	}
+	if len(pi.pendingCloses) != 1 {
+		t.Fatal(len(pi.pendingCloses))
+	}
+	_ = pi.conn.Close()
+	ids := <-sent
+	if !reflect.DeepEqual(ids, []Identifies{IdentifiesClose, IdentifiesSync, IdentifiesQuery,
+		IdentifiesBind, IdentifiesFlush, IdentifiesExecute, IdentifiesSync}) {
+		t.Fatalf("%q", ids)
+	}
+}
+
+func TestParseQueryPortal(t *testing.T) {
+	bind := testReceived(newBind("p1", "s1", []interface{}{"x"}, nil))
+	if portal, name := bind.string(), bind.string(); portal != "p1" || name != "s1" {
+		t.Fatal(portal, name)
+	}
+
+	pi := testPgIO(t,
+		NewPgMessage(IdentifiesBindComplete),
+		testDataRow("1"),
+		testMsg(IdentifiesCommandComplete, "SELECT 1"),
+		testReadyForQuery(TransactionStatusIdleInTransaction),
+		NewPgMessage(IdentifiesBindComplete),
+		testMsg(IdentifiesCommandComplete, "UPDATE 2"),
+		testReadyForQuery(TransactionStatusIdleInTransaction),
+	)
+	defer pi.conn.Close()
+	_, data, err := pi.ParseQueryPortal("p1", "s1", nil)
+	if err != nil || len(*data) != 1 {
+		t.Fatal(err)
+	}
+	if _, n, err := pi.ParseExecPortal("p2", "s2", nil); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestProtocolViolation(t *testing.T) {
+	pi := testPgIO(t, NewPgMessage('?'))
+	defer pi.conn.Close()
+	if _, _, err := pi.QueryNoArgsExec("select 1"); err != ErrProtocolViolation {
+		t.Fatal(err)
+	}
+	if pi.IOError != ErrProtocolViolation {
+		t.Fatal(pi.IOError)
+	}
+	for _, id := range []byte{IdentifiesDataRow, IdentifiesReadyForQuery, IdentifiesNegotiateProtocol} {
+		if !validateIdentifies(id) {
+			t.Fatalf("%q", id)
+		}
+	}
+	for _, id := range []byte{0, 'Q', 'P', 'x'} {
+		if validateIdentifies(id) {
+			t.Fatalf("%q", id)
+		}
+	}
+}
+
+func TestMessageTooLong(t *testing.T) {
+	for _, once := range []bool{true, false} {
+		client, server := net.Pipe()
+		go func() {
+			// 声明的长度接近 2GB，不应按其分配内存
+			_, _ = server.Write([]byte{IdentifiesDataRow, 0x7f, 0xff, 0xff, 0xff})
+		}()
+		pi := NewPgIO(nil)
+		pi.setConn(client)
+		var err error
+		if once {
+			_, err = pi.receivePgMsgOnce()
+		} else {
+			_, err = pi.receivePgMsg(IdentifiesReadyForQuery)
+		}
+		if err != ErrMalformedMessage || pi.IOError != ErrMalformedMessage {
+			t.Fatal(once, err, pi.IOError)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestRowDescriptionChanged(t *testing.T) {
+	var cols = []PgColumn{{Name: "id", TypeOid: 23}, {Name: "name", TypeOid: 25}}
+	if RowDescriptionChanged(cols, []PgColumn{{Name: "id", TypeOid: 23}, {Name: "name", TypeOid: 25}}) {
+		t.Fatal("same columns")
+	}
+	if !RowDescriptionChanged(cols, append(cols, PgColumn{Name: "email", TypeOid: 25})) {
+		t.Fatal("added column")
+	}
+	if !RowDescriptionChanged(cols, []PgColumn{{Name: "id", TypeOid: 20}, {Name: "name", TypeOid: 25}}) {
+		t.Fatal("changed type")
+	}
+}
+
+// 读取 StartUp 发出的启动消息中的参数，之后回复 AuthenticationOk 及 ReadyForQuery
+func testStartupParams(t *testing.T, dsn *helper.DataSourceName) map[string]string {
+	client, server := net.Pipe()
+	var params = make(chan map[string]string, 1)
+	go func() {
+		defer server.Close()
+		var m = make(map[string]string)
+		defer func() { params <- m }()
+		var l [4]byte
+		if _, err := io.ReadFull(server, l[:]); err != nil {
+			return
+		}
+		var body = make([]byte, binary.BigEndian.Uint32(l[:])-4)
+		if _, err := io.ReadFull(server, body); err != nil {
+			return
+		}
+		// 协议版本之后是以 NUL 结尾的键值对，以空串结束
+		var fields = strings.Split(string(body[4:]), "\x00")
+		for i := 0; i+1 < len(fields) && fields[i] != ""; i += 2 {
+			m[fields[i]] = fields[i+1]
+		}
+		ok := NewPgMessage(IdentifiesAuth)
+		ok.addInt32(0)
+		for _, msg := range []*PgMessage{ok, testReadyForQuery(TransactionStatusIdle)} {
+			if _, err := server.Write(msg.encode()); err != nil {
+				return
+			}
+		}
+	}()
+	pi := NewPgIO(dsn)
+	pi.setConn(client)
+	if err := pi.StartUp(); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	return <-params
+}
+
+// application_name 的优先级：数据源中的 application_name、PGAPPNAME、fallback_application_name、程序名。
+// 服务端不接受 fallback_application_name 作为启动参数，它从不发送
+func TestStartUpApplicationName(t *testing.T) {
+	var pgAppName, hasEnv = os.LookupEnv("PGAPPNAME")
+	defer func() {
+		if hasEnv {
+			_ = os.Setenv("PGAPPNAME", pgAppName)
+		} else {
+			_ = os.Unsetenv("PGAPPNAME")
+		}
+	}()
+
+	for _, c := range []struct {
+		dsn, env, want string
+	}{
+		{"user=postgres sslmode=disable application_name=app fallback_application_name=lib", "env", "app"},
+		{"user=postgres sslmode=disable fallback_application_name=lib", "env", "env"},
+		{"user=postgres sslmode=disable fallback_application_name=lib", "", "lib"},
+		{"user=postgres sslmode=disable", "", filepath.Base(os.Args[0])},
+	} {
+		if c.env == "" {
+			_ = os.Unsetenv("PGAPPNAME")
+		} else {
+			_ = os.Setenv("PGAPPNAME", c.env)
+		}
+		dsn, err := helper.ParseDSN(c.dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var params = testStartupParams(t, dsn)
+		if params["application_name"] != c.want || params["user"] != "postgres" {
+			t.Fatal(c.dsn, c.env, params)
+		}
+		if _, has := params["fallback_application_name"]; has {
+			t.Fatal(c.dsn, "fallback_application_name must not be sent to the server")
+		}
+	}
+}
+
+func TestCancelNotSupported(t *testing.T) {
+	ok := NewPgMessage(IdentifiesAuth)
+	ok.addInt32(0)
+	pi := testPgIO(t, ok, testReadyForQuery(TransactionStatusIdle))
+	defer pi.conn.Close()
+	pi.dsn.SSL.Mode = helper.SSLModeDisable
+	if err := pi.StartUp(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.CancelRequest(); err != ErrCancelNotSupported {
+		t.Fatal(err)
+	}
+}
+
+// 循环重放 data 的 io.Reader
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *loopReader) Read(b []byte) (n int, err error) {
+	n = copy(b, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return
+}
+
+// BEGIN、COMMIT 各自的应答只有 CommandComplete + ReadyForQuery
+func BenchmarkReceiveCommandComplete(b *testing.B) {
+	var data []byte
+	for _, m := range []*PgMessage{
+		testMsg(IdentifiesCommandComplete, "BEGIN"), testReadyForQuery('T'),
+		testMsg(IdentifiesCommandComplete, "COMMIT"), testReadyForQuery('I'),
+	} {
+		data = append(data, m.encode()...)
+	}
+	pi := NewPgIO(nil)
+	pi.reader = bufio.NewReader(&loopReader{data: data})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := pi.receivePgMsg(IdentifiesReadyForQuery); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
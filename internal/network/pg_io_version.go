@@ -0,0 +1,35 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+// parseServerVersion 解析 server_version，如 "9.6.24"、"16.2"、"15devel"、
+// "14.5 (Debian 14.5-1.pgdg110+1)"。每段只取开头的数字，缺少的段为 0
+func parseServerVersion(s string) (v [3]int) {
+	var i = 0
+	for part := 0; part < len(v); part++ {
+		var start = i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			v[part] = v[part]*10 + int(s[i]-'0')
+			i++
+		}
+		if i == start || i >= len(s) || s[i] != '.' {
+			return
+		}
+		i++
+	}
+	return
+}
+
+// ServerMajorVersion 服务端的主版本号，10 起版本号只有两段，如 16.2 的 16；启动前为 0
+func (pi *PgIO) ServerMajorVersion() int {
+	return pi.serverVersion[0]
+}
+
+// ServerMinorVersion 服务端的次版本号：10 以前为第二段，如 9.6 的 6；10 起为小版本，如 16.2 的 2
+func (pi *PgIO) ServerMinorVersion() int {
+	return pi.serverVersion[1]
+}
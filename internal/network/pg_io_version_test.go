@@ -0,0 +1,37 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import "testing"
+
+func TestParseServerVersion(t *testing.T) {
+	var cases = []struct {
+		in  string
+		out [3]int
+	}{
+		{"9.6.24", [3]int{9, 6, 24}},
+		{"16.2", [3]int{16, 2, 0}},
+		{"15devel", [3]int{15, 0, 0}},
+		{"16beta1", [3]int{16, 0, 0}},
+		{"14.5 (Debian 14.5-1.pgdg110+1)", [3]int{14, 5, 0}},
+		{"", [3]int{}},
+	}
+	for _, c := range cases {
+		if v := parseServerVersion(c.in); v != c.out {
+			t.Fatal(c.in, v)
+		}
+	}
+
+	var pi = NewPgIO(nil)
+	var msg = NewPgMessage(IdentifiesParameterStatus)
+	msg.addString("server_version")
+	msg.addString("9.6.24")
+	pi.parameterStatus(testReceived(msg))
+	if pi.ServerMajorVersion() != 9 || pi.ServerMinorVersion() != 6 {
+		t.Fatal(pi.serverVersion)
+	}
+}
@@ -9,7 +9,10 @@ package network
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"github.com/blusewang/pg/internal/helper"
 	"strconv"
+	"strings"
 )
 
 func NewPgMessage(identifies Identifies) *PgMessage {
@@ -25,10 +28,30 @@ type PgMessage struct {
 	Len        uint32
 	Content    []byte
 	Position   uint32
+	// 读取越界，说明消息内容不完整
+	overrun bool
+	// 构造消息时的错误，如字符串中含 NUL，发送前检查
+	err error
+}
+
+// ErrMalformedMessage 服务端消息的内容与其声明的长度不符
+var ErrMalformedMessage = errors.New("pg: malformed message from server")
+
+// ErrNulInString 协议中的字符串以 NUL 结尾，本身不能含 NUL，否则会被截断。
+// 与 helper.ErrNulInString 是同一个值，QuoteIdentifier 的错误也可与它比较
+var ErrNulInString = helper.ErrNulInString
+
+// remain 检查剩余内容是否还有 n 个字节，不足时记录 overrun
+func (pm *PgMessage) remain(n uint32) bool {
+	if uint64(pm.Position)+uint64(n) > uint64(len(pm.Content)) {
+		pm.overrun = true
+		return false
+	}
+	return true
 }
 
 func (pm *PgMessage) int32() (n uint32) {
-	if pm.Position >= pm.Len {
+	if !pm.remain(4) {
 		return 0
 	}
 	n = binary.BigEndian.Uint32(pm.Content[pm.Position:])
@@ -37,7 +60,7 @@ func (pm *PgMessage) int32() (n uint32) {
 }
 
 func (pm *PgMessage) int16() (n uint16) {
-	if pm.Position >= pm.Len {
+	if !pm.remain(2) {
 		return 0
 	}
 	n = binary.BigEndian.Uint16(pm.Content[pm.Position:])
@@ -46,19 +69,20 @@ func (pm *PgMessage) int16() (n uint16) {
 }
 
 func (pm *PgMessage) string() string {
-	if pm.Position >= pm.Len {
+	if !pm.remain(1) {
 		return ""
 	}
-	i := uint32(bytes.IndexByte(pm.Content[pm.Position:], 0))
+	i := bytes.IndexByte(pm.Content[pm.Position:], 0)
 	if i < 0 {
+		pm.overrun = true
 		return ""
 	}
-	defer pm.move(i + 1)
-	return string(pm.Content[pm.Position : pm.Position+i])
+	defer pm.move(uint32(i) + 1)
+	return string(pm.Content[pm.Position : pm.Position+uint32(i)])
 }
 
 func (pm *PgMessage) byte() byte {
-	if pm.Position >= pm.Len {
+	if !pm.remain(1) {
 		return 0
 	}
 	defer pm.move(1)
@@ -66,12 +90,8 @@ func (pm *PgMessage) byte() byte {
 }
 
 func (pm *PgMessage) bytes(n uint32) []byte {
-
-	if pm.Position >= pm.Len {
-		return []byte{}
-	}
-	if pm.Position+n > pm.Len {
-		n = pm.Len - pm.Position
+	if !pm.remain(n) {
+		return nil
 	}
 	defer pm.move(n)
 	return pm.Content[pm.Position : pm.Position+n]
@@ -81,8 +101,9 @@ func (pm *PgMessage) move(n uint32) {
 	pm.Position += n
 }
 
+// ParseError 解析 ErrorResponse，NoticeResponse 的字段格式与之相同
 func (pm *PgMessage) ParseError() (err *PgError) {
-	if pm.Identifies != IdentifiesErrorResponse {
+	if pm.Identifies != IdentifiesErrorResponse && pm.Identifies != IdentifiesNoticeResponse {
 		return
 	}
 	err = new(PgError)
@@ -93,6 +114,8 @@ func (pm *PgMessage) ParseError() (err *PgError) {
 		case 'V':
 			err.Text = s[1:]
 		case 'C':
+			// SQLSTATE 可能含字母，如 42P01，此时 Code 为 0
+			err.SQLState = s[1:]
 			err.Code, _ = strconv.Atoi(s[1:])
 		case 'M':
 			err.Message = s[1:]
@@ -137,17 +160,52 @@ func (pm *PgMessage) columns() (list []PgColumn) {
 	for n := uint16(0); n < count; n++ {
 		var c PgColumn
 		c.Name = pm.string()
-		c.TableOid = pm.int32()
-		c.Index = pm.int16()
+		c.TableOID = pm.int32()
+		c.AttributeNumber = pm.int16()
 		c.TypeOid = pm.int32()
 		c.Len = pm.int16()
-		c.TypeModifier = pm.int32()
-		c.Format = pm.int16()
+		c.TypeModifier = int32(pm.int32())
+		c.FormatCode = pm.int16()
+		if pm.overrun {
+			break
+		}
 		list = append(list, c)
 	}
 	return
 }
 
+func (pm *PgMessage) notification() (n *Notification) {
+	if pm.Identifies != IdentifiesNotificationResponse {
+		return
+	}
+	n = new(Notification)
+	n.PID = pm.int32()
+	n.Channel = pm.string()
+	n.Payload = pm.string()
+	return
+}
+
+func (pm *PgMessage) dataRow() (rowLen []uint32, row [][]byte) {
+	if pm.Identifies != IdentifiesDataRow {
+		return
+	}
+	length := pm.int16()
+	for i := uint16(0); i < length; i++ {
+		l := pm.int32()
+		var v []byte
+		if l != 4294967295 {
+			// 4294967295 即 -1，表示 NULL
+			v = pm.bytes(l)
+		}
+		if pm.overrun {
+			break
+		}
+		row = append(row, v)
+		rowLen = append(rowLen, l)
+	}
+	return
+}
+
 func (pm *PgMessage) addInt32(n int) {
 	x := make([]byte, 4)
 	binary.BigEndian.PutUint32(x, uint32(n))
@@ -160,7 +218,14 @@ func (pm *PgMessage) addInt16(n int) {
 	pm.Content = append(pm.Content, x...)
 }
 
+// addString 追加以 NUL 结尾的字符串；含 NUL 时不追加，错误在发送时返回
 func (pm *PgMessage) addString(s string) {
+	if strings.IndexByte(s, 0) >= 0 {
+		if pm.err == nil {
+			pm.err = ErrNulInString
+		}
+		return
+	}
 	pm.Content = append(pm.Content, s+"\000"...)
 }
 
@@ -172,6 +237,17 @@ func (pm *PgMessage) addBytes(v []byte) {
 	pm.Content = append(pm.Content, v...)
 }
 
+// 客户端发出后需要服务端立即处理的消息
+func (pm *PgMessage) isFlushPoint() bool {
+	switch pm.Identifies {
+	case IdentifiesSync, IdentifiesFlush, IdentifiesQuery, IdentifiesTerminate,
+		IdentifiesPasswordMessage, IdentifiesCopyDone, IdentifiesCopyFail, IdentifiesFunctionCall:
+		return true
+	default:
+		return false
+	}
+}
+
 func (pm *PgMessage) encode() (raw []byte) {
 	raw = append(raw, byte(pm.Identifies))
 	binary.BigEndian.PutUint32(pm.Content, uint32(len(pm.Content)))
@@ -0,0 +1,52 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build go1.18
+// +build go1.18
+
+package network
+
+import "testing"
+
+// go test -fuzz FuzzPgMessage ./internal/network
+func FuzzPgMessage(f *testing.F) {
+	for _, m := range []*PgMessage{
+		testRowDescription("a", "b"),
+		testDataRow("1", "abc"),
+		testMsg(IdentifiesErrorResponse, "SERROR", "C42601", "Msyntax error", ""),
+		testMsg(IdentifiesNotificationResponse, "jobs", "42"),
+		testReadyForQuery(TransactionStatusIdle),
+	} {
+		f.Add(m.encode())
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		if len(raw) == 0 {
+			return
+		}
+		for _, id := range []Identifies{
+			Identifies(raw[0]),
+			IdentifiesRowDescription,
+			IdentifiesDataRow,
+			IdentifiesErrorResponse,
+			IdentifiesNotificationResponse,
+		} {
+			var msg = PgMessage{Identifies: id, Len: uint32(len(raw) - 1), Content: raw[1:], Position: 4}
+			_ = msg.columns()
+			msg.Position = 4
+			_, _ = msg.dataRow()
+			msg.Position = 4
+			_ = msg.ParseError()
+			msg.Position = 4
+			_ = msg.notification()
+			msg.Position = 4
+			_ = msg.byte()
+			_ = msg.int16()
+			_ = msg.int32()
+			_ = msg.bytes(uint32(len(raw)))
+			_ = msg.string()
+		}
+	})
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+import "testing"
+
+// 把编码后的消息还原为接收时的状态
+func testReceived(m *PgMessage) PgMessage {
+	raw := m.encode()
+	return PgMessage{Identifies: Identifies(raw[0]), Len: uint32(len(raw) - 1), Content: raw[1:], Position: 4}
+}
+
+func TestParseError(t *testing.T) {
+	m := testMsg(IdentifiesErrorResponse,
+		"SERROR", "VERROR", "C42601", `Msyntax error at or near "selec"`, "Ddetail", "Hhint",
+		"P1", "p2", "qinternal", "Wwhere", "sschema", "ttable", "ccolumn", "ddata_type", "nconstraint",
+		"Fscan.l", "L1180", "Rscanner_yyerror", "")
+	msg := testReceived(m)
+	e := msg.ParseError()
+	if e.Severity != "ERROR" || e.Text != "ERROR" || e.SQLState != "42601" || e.Code != 42601 {
+		t.Fatal(e.Json())
+	}
+	if e.Message != `syntax error at or near "selec"` || e.Detail != "detail" || e.Hint != "hint" {
+		t.Fatal(e.Json())
+	}
+	if e.Position != 1 || e.InternalPosition != 2 || e.InternalQuery != "internal" || e.Where != "where" {
+		t.Fatal(e.Json())
+	}
+	if e.Schema != "schema" || e.Table != "table" || e.Column != "column" || e.DataType != "data_type" || e.Constraint != "constraint" {
+		t.Fatal(e.Json())
+	}
+	if e.File != "scan.l" || e.Line != 1180 || e.Routine != "scanner_yyerror" {
+		t.Fatal(e.Json())
+	}
+
+	msg = testReceived(testMsg(IdentifiesErrorResponse, "SERROR", "C42P01", "Mrelation does not exist", ""))
+	if e = msg.ParseError(); e.SQLState != "42P01" {
+		t.Fatal(e.Json())
+	}
+}
+
+func TestColumns(t *testing.T) {
+	m := NewPgMessage(IdentifiesRowDescription)
+	m.addInt16(2)
+	m.addString("id")
+	m.addInt32(16384)
+	m.addInt16(1)
+	m.addInt32(23)
+	m.addInt16(4)
+	m.addInt32(-1)
+	m.addInt16(FormatText)
+	m.addString("?column?")
+	m.addInt32(0)
+	m.addInt16(0)
+	m.addInt32(25)
+	m.addInt16(-1)
+	m.addInt32(-1)
+	m.addInt16(FormatText)
+	msg := testReceived(m)
+	cols := msg.columns()
+	if len(cols) != 2 {
+		t.Fatal(cols)
+	}
+	if cols[0].Name != "id" || cols[0].TableOID != 16384 || cols[0].AttributeNumber != 1 || cols[0].TypeOid != 23 || cols[0].IsExpression() {
+		t.Fatal(cols[0])
+	}
+	if cols[1].TableOID != 0 || cols[1].AttributeNumber != 0 || !cols[1].IsExpression() {
+		t.Fatal(cols[1])
+	}
+}
+
+// 对应 create table t (amount numeric(10,2), code varchar(20), note numeric)
+func TestColumnTypeModifier(t *testing.T) {
+	m := NewPgMessage(IdentifiesRowDescription)
+	m.addInt16(3)
+	for _, c := range []struct {
+		name string
+		oid  uint32
+		mod  int
+	}{
+		{"amount", oidNumeric, 10<<16 | 2 + 4},
+		{"code", oidVarchar, 20 + 4},
+		{"note", oidNumeric, -1},
+	} {
+		m.addString(c.name)
+		m.addInt32(16384)
+		m.addInt16(1)
+		m.addInt32(int(c.oid))
+		m.addInt16(-1)
+		m.addInt32(c.mod)
+		m.addInt16(FormatText)
+	}
+	msg := testReceived(m)
+	cols := msg.columns()
+	if len(cols) != 3 {
+		t.Fatal(cols)
+	}
+	if p, ok := cols[0].NumericPrecision(); !ok || p != 10 {
+		t.Fatal(p, ok)
+	}
+	if s, ok := cols[0].NumericScale(); !ok || s != 2 {
+		t.Fatal(s, ok)
+	}
+	if _, ok := cols[0].CharMaxLength(); ok {
+		t.Fatal("numeric has no char length")
+	}
+	if n, ok := cols[1].CharMaxLength(); !ok || n != 20 {
+		t.Fatal(n, ok)
+	}
+	if _, ok := cols[1].NumericPrecision(); ok {
+		t.Fatal("varchar has no precision")
+	}
+	if cols[2].TypeModifier != -1 {
+		t.Fatal(cols[2].TypeModifier)
+	}
+	if _, ok := cols[2].NumericPrecision(); ok {
+		t.Fatal("unconstrained numeric has no precision")
+	}
+	if _, ok := cols[2].NumericScale(); ok {
+		t.Fatal("unconstrained numeric has no scale")
+	}
+	if _, ok := (PgColumn{TypeOid: oidVarchar, TypeModifier: -1}).CharMaxLength(); ok {
+		t.Fatal("unconstrained varchar has no length")
+	}
+}
+
+func TestMessageOverrun(t *testing.T) {
+	// DataRow 声明了 2 列，第二列的长度超出消息
+	m := NewPgMessage(IdentifiesDataRow)
+	m.addInt16(2)
+	m.addInt32(1)
+	m.addBytes([]byte("a"))
+	m.addInt32(100)
+	m.addBytes([]byte("b"))
+	msg := testReceived(m)
+	rowLen, row := msg.dataRow()
+	if !msg.overrun || len(row) != 1 || len(rowLen) != 1 {
+		t.Fatal(rowLen, row)
+	}
+
+	msg = PgMessage{Identifies: IdentifiesCommandComplete, Len: 6, Content: []byte{0, 0, 0, 6, 'a', 'b'}, Position: 4}
+	if s := msg.string(); s != "" || !msg.overrun {
+		t.Fatal(s)
+	}
+	msg = PgMessage{Identifies: IdentifiesReadyForQuery, Len: 5, Content: []byte{0, 0, 0, 5, 'I'}, Position: 4}
+	if msg.byte() != 'I' || msg.overrun {
+		t.Fatal("unexpected overrun")
+	}
+	if msg.int32() != 0 || !msg.overrun {
+		t.Fatal("expect overrun")
+	}
+}
+
+func TestAddStringNul(t *testing.T) {
+	m := NewPgMessage(IdentifiesQuery)
+	m.addString("ab")
+	if m.err != nil || string(m.Content[4:]) != "ab\x00" {
+		t.Fatal(m.err, m.Content)
+	}
+	m.addString("select 1\x00; drop table t")
+	if m.err != ErrNulInString || string(m.Content[4:]) != "ab\x00" {
+		t.Fatal(m.err, m.Content)
+	}
+
+	// 有误的消息不会发出，连接仍然可用
+	pi := testPgIO(t)
+	defer pi.conn.Close()
+	if _, _, _, err := pi.QueryNoArgs("select 1\x00"); err != ErrNulInString {
+		t.Fatal(err)
+	}
+	if pi.IOError != nil {
+		t.Fatal(pi.IOError)
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+// Notification 由 NOTIFY 发出的异步通知
+type Notification struct {
+	// 发出通知的服务端进程ID
+	PID     uint32
+	Channel string
+	Payload string
+}
@@ -0,0 +1,14 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package network
+
+// ResultSet 一条语句返回的结果集
+type ResultSet struct {
+	Columns  []PgColumn
+	FieldLen *[][]uint32
+	Rows     *[][][]byte
+}
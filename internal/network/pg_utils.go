@@ -39,6 +39,11 @@ func value2bytes(value interface{}) []byte {
 	}
 }
 
+// TextValue 返回参数的文本格式编码，与 Bind 时发送的内容一致
+func TextValue(value interface{}) []byte {
+	return value2bytes(value)
+}
+
 func formatTimestamp(t time.Time) []byte {
 	// Need to send dates before 0001 A.D. with " BC" suffix, instead of the
 	// minus sign preferred by Go.
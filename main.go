@@ -10,12 +10,26 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	dr "github.com/blusewang/pg/internal/driver"
+	"github.com/blusewang/pg/internal/network"
 )
 
 func init() {
 	sql.Register("pg", &dr.PgDriver{})
 }
 
+// TID 对应PG的 tid 类型，可用于 Scan 目标或 where ctid = $1 的参数
+type TID = dr.TID
+
+// PgError 服务端返回的错误及提示，也是 PgConn.SetNoticeHandler 回调的参数
+type PgError = network.PgError
+
+// ErrColumnLayoutChanged 表结构变更使预备语句的结果列发生了变化，刷新列映射后重试即可。
+// 以 errors.Is 判断；返回的错误为 *ColumnLayoutChangedError，其中保留服务端原始的 PgError
+var ErrColumnLayoutChanged = network.ErrColumnLayoutChanged
+
+// ColumnLayoutChangedError 见 ErrColumnLayoutChanged
+type ColumnLayoutChangedError = network.ColumnLayoutChangedError
+
 func NewConnector(dataSourceName string) driver.Connector {
 	return &dr.PgConnector{Name: dataSourceName}
 }
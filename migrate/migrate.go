@@ -0,0 +1,177 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package migrate 按版本顺序执行目录中的 SQL 迁移文件，文件名形如 V001__create_users.sql
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 会话级咨询锁的键，即 "migrate" 的 ASCII 编码
+const lockKey = 0x6d696772617465
+
+const createTable = `create table if not exists schema_migrations (
+	version bigint primary key,
+	description text not null,
+	checksum text not null,
+	applied_at timestamptz not null default now()
+)`
+
+var fileName = regexp.MustCompile(`^V(\d+)__(.+)\.sql$`)
+
+// MigrationsRunner 以咨询锁防止多个实例同时迁移，每个迁移在单独的事务中执行，
+// 并在 schema_migrations 中记录版本、校验和及执行时间。已执行的迁移文件被修改时报错
+type MigrationsRunner struct {
+	db  *sql.DB
+	dir string
+}
+
+func NewMigrationsRunner(db *sql.DB, dir string) *MigrationsRunner {
+	return &MigrationsRunner{db: db, dir: dir}
+}
+
+type migration struct {
+	version     int64
+	description string
+	file        string
+	checksum    string
+	body        string
+}
+
+// Run 执行全部尚未执行的迁移，出错时停止，之前已完成的迁移保留
+func (r *MigrationsRunner) Run(ctx context.Context) (err error) {
+	ms, err := scan(r.dir)
+	if err != nil {
+		return
+	}
+	// 咨询锁属于会话，加锁、迁移及解锁须在同一个连接上
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "select pg_advisory_lock($1)", lockKey); err != nil {
+		return
+	}
+	defer func() {
+		if _, e := conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", lockKey); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if _, err = conn.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+	applied, err := appliedChecksums(ctx, conn)
+	if err != nil {
+		return
+	}
+	for _, m := range ms {
+		if checksum, has := applied[m.version]; has {
+			if checksum != m.checksum {
+				return fmt.Errorf("migrate: %v was changed after it was applied", m.file)
+			}
+			continue
+		}
+		if err = apply(ctx, conn, m); err != nil {
+			return fmt.Errorf("migrate: %v: %v", m.file, err)
+		}
+	}
+	return
+}
+
+func appliedChecksums(ctx context.Context, conn *sql.Conn) (applied map[int64]string, err error) {
+	rows, err := conn.QueryContext(ctx, "select version, checksum from schema_migrations")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	applied = make(map[int64]string)
+	for rows.Next() {
+		var version int64
+		var checksum string
+		if err = rows.Scan(&version, &checksum); err != nil {
+			return
+		}
+		applied[version] = checksum
+	}
+	return applied, rows.Err()
+}
+
+func apply(ctx context.Context, conn *sql.Conn, m migration) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	// 不带参数的 Exec 以简单查询协议执行（见 PgConn.ExecContext），一个文件中可以有多条语句
+	if _, err = tx.ExecContext(ctx, m.body); err != nil {
+		return
+	}
+	_, err = tx.ExecContext(ctx, "insert into schema_migrations (version, description, checksum) values ($1, $2, $3)",
+		m.version, m.description, m.checksum)
+	if err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// scan 读取 dir 中的迁移文件并按版本排序。其它扩展名的文件被忽略，
+// 命名不合规范的 .sql 文件及重复的版本号视为错误
+func scan(dir string) (ms []migration, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var seen = make(map[int64]string)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".sql") {
+			continue
+		}
+		var match = fileName.FindStringSubmatch(f.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrate: %v: file name must look like V001__description.sql", f.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %v: %v", f.Name(), err)
+		}
+		if other, has := seen[version]; has {
+			return nil, fmt.Errorf("migrate: %v and %v have the same version", other, f.Name())
+		}
+		seen[version] = f.Name()
+		body, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var sum = sha256.Sum256(body)
+		ms = append(ms, migration{
+			version:     version,
+			description: strings.Replace(match[2], "_", " ", -1),
+			file:        f.Name(),
+			checksum:    hex.EncodeToString(sum[:]),
+			body:        string(body),
+		})
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].version < ms[j].version
+	})
+	return
+}
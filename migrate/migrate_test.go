@@ -0,0 +1,96 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/blusewang/pg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestScan(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"V010__add_email.sql":    "alter table users add column email text",
+		"V002__create_users.sql": "create table users (id int8)",
+		"README.md":              "migrations",
+	})
+	defer os.RemoveAll(dir)
+	ms, err := scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].version != 2 || ms[1].version != 10 || ms[1].description != "add email" {
+		t.Fatal(ms)
+	}
+
+	for _, files := range []map[string]string{
+		{"create_users.sql": ""},
+		{"V1__a.sql": "", "V001__b.sql": ""},
+	} {
+		dir := testDir(t, files)
+		defer os.RemoveAll(dir)
+		if _, err = scan(dir); err == nil {
+			t.Fatal(files)
+		}
+	}
+}
+
+// 需要真实的PG服务，通过环境变量 PG_DSN 指定数据源，未指定时跳过
+func TestRun(t *testing.T) {
+	var dsn = os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PG_DSN not set")
+	}
+	db, err := sql.Open("pg", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, _ = db.Exec("drop table if exists schema_migrations, migrate_users")
+	defer db.Exec("drop table if exists schema_migrations, migrate_users")
+
+	dir := testDir(t, map[string]string{
+		"V001__create_users.sql": "create table migrate_users (id int8); insert into migrate_users values (1);",
+	})
+	defer os.RemoveAll(dir)
+	var r = NewMigrationsRunner(db, dir)
+	if err = r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 再次执行不会重复迁移
+	if err = r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err = db.QueryRow("select count(*) from migrate_users").Scan(&n); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "V001__create_users.sql"), []byte("select 1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Run(context.Background()); err == nil {
+		t.Fatal("a changed migration must fail")
+	}
+}
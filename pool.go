@@ -0,0 +1,149 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// 连接池由 database/sql 管理，Pool 只在 *sql.DB 之上补充预热、优雅关闭等辅助功能
+
+// Pool 包装 *sql.DB，其余方法直接使用 DB
+type Pool struct {
+	*sql.DB
+	// MinConns Warm 预先建立的连接数。调用方应保证 db.SetMaxIdleConns 不小于该值，
+	// 否则多余的连接会在归还时被关闭
+	MinConns int
+	// AfterConnect 不为 nil 时，Warm 在确认连接可用后对每个连接调用一次，如设置会话参数
+	AfterConnect func(ctx context.Context, conn *sql.Conn) error
+
+	mu sync.Mutex
+	// Acquire 取出尚未 Release 的连接数
+	inUse int
+	// Drain 之后不为 nil，inUse 降为 0 时关闭
+	done chan struct{}
+}
+
+// NewPool 以 db 创建 Pool
+func NewPool(db *sql.DB) *Pool {
+	return &Pool{DB: db}
+}
+
+// WarmError 记录预热时失败的连接
+type WarmError []error
+
+func (e WarmError) Error() string {
+	var list []string
+	for _, err := range e {
+		list = append(list, err.Error())
+	}
+	return fmt.Sprintf("pg: %d connection(s) failed to warm up: %s", len(e), strings.Join(list, "; "))
+}
+
+// Warm 并发建立 MinConns 个连接，确认服务端可用并执行 AfterConnect，全部完成后将它们归还给连接池。
+// 用于服务启动时尽早发现数据库不可用。有连接失败时返回 WarmError，ctx 结束时返回 ctx.Err()
+func (p *Pool) Warm(ctx context.Context) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var conns []*sql.Conn
+	var errs WarmError
+	for i := 0; i < p.MinConns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := p.DB.Conn(ctx)
+			if err == nil {
+				err = conn.PingContext(ctx)
+			}
+			if err == nil && p.AfterConnect != nil {
+				err = p.AfterConnect(ctx, conn)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if conn != nil {
+				conns = append(conns, conn)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("connection %d: %v", i, err))
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ErrPoolDrained Drain 之后 Acquire 返回的错误
+var ErrPoolDrained = errors.New("pg: pool is drained")
+
+// Acquire 从连接池取出一个连接，用完后须以 Release 归还。Drain 之后返回 ErrPoolDrained
+func (p *Pool) Acquire(ctx context.Context) (*sql.Conn, error) {
+	p.mu.Lock()
+	if p.done != nil {
+		p.mu.Unlock()
+		return nil, ErrPoolDrained
+	}
+	p.inUse++
+	p.mu.Unlock()
+	conn, err := p.DB.Conn(ctx)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Release 归还 Acquire 取得的连接
+func (p *Pool) Release(conn *sql.Conn) error {
+	defer p.release()
+	return conn.Close()
+}
+
+func (p *Pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse--
+	if p.done != nil && p.inUse == 0 {
+		close(p.done)
+	}
+}
+
+// Drain 优雅关闭连接池：之后的 Acquire 返回 ErrPoolDrained，等待 Acquire 取出的连接全部 Release 后
+// 关闭 DB，空闲连接随之关闭（PgConn.Close 会向服务端发送 Terminate）。
+// ctx 结束时不再等待，同样关闭 DB 并返回 ctx.Err()，尚未归还的连接在 Release 时关闭。
+// 不经 Acquire 直接使用 DB 的查询不在等待之列
+func (p *Pool) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	if p.done == nil {
+		p.done = make(chan struct{})
+		if p.inUse == 0 {
+			close(p.done)
+		}
+	}
+	var done = p.done
+	p.mu.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		_ = p.DB.Close()
+		return ctx.Err()
+	}
+	return p.DB.Close()
+}
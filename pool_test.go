@@ -0,0 +1,234 @@
+// Copyright 2019 MQ, Inc. All rights reserved.
+//
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConnector 不连接服务端的驱动，记录建立及关闭的连接数
+type testConnector struct {
+	mu     sync.Mutex
+	opened int
+	closed int
+	// fail 不为 nil 时，第 n 次建立连接返回它的结果
+	fail func(n int) error
+	// block 不为 nil 时，建立连接一直等到它关闭或 ctx 结束
+	block chan struct{}
+}
+
+func (tc *testConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	tc.mu.Lock()
+	tc.opened++
+	var n = tc.opened
+	tc.mu.Unlock()
+	if tc.block != nil {
+		select {
+		case <-tc.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if tc.fail != nil {
+		if err := tc.fail(n); err != nil {
+			return nil, err
+		}
+	}
+	return &testDriverConn{tc: tc}, nil
+}
+
+func (tc *testConnector) Driver() driver.Driver {
+	return testDriver{}
+}
+
+func (tc *testConnector) counts() (opened, closed int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.opened, tc.closed
+}
+
+type testDriver struct{}
+
+func (testDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("use the connector")
+}
+
+type testDriverConn struct {
+	tc *testConnector
+}
+
+func (c *testDriverConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *testDriverConn) Close() error {
+	c.tc.mu.Lock()
+	c.tc.closed++
+	c.tc.mu.Unlock()
+	return nil
+}
+
+func (c *testDriverConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestPoolWarm(t *testing.T) {
+	var tc = new(testConnector)
+	var db = sql.OpenDB(tc)
+	defer db.Close()
+	db.SetMaxIdleConns(4)
+
+	var p = NewPool(db)
+	p.MinConns = 4
+	var mu sync.Mutex
+	var after int
+	p.AfterConnect = func(ctx context.Context, conn *sql.Conn) error {
+		mu.Lock()
+		after++
+		mu.Unlock()
+		return nil
+	}
+	if err := p.Warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if opened, closed := tc.counts(); opened != 4 || closed != 0 || after != 4 {
+		t.Fatal(opened, closed, after)
+	}
+	// 预热的连接已归还给连接池
+	if n := db.Stats().Idle; n != 4 {
+		t.Fatal(n)
+	}
+}
+
+func TestPoolWarmPartialFailure(t *testing.T) {
+	var tc = &testConnector{fail: func(n int) error {
+		if n%2 == 0 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+	var db = sql.OpenDB(tc)
+	defer db.Close()
+	db.SetMaxIdleConns(4)
+
+	var p = NewPool(db)
+	p.MinConns = 4
+	err := p.Warm(context.Background())
+	e, ok := err.(WarmError)
+	if !ok || len(e) != 2 {
+		t.Fatal(err)
+	}
+	for _, err := range e {
+		if !strings.Contains(err.Error(), "connection refused") {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(e.Error(), "2 connection(s) failed") {
+		t.Fatal(e.Error())
+	}
+
+	// AfterConnect 的错误同样计入
+	p.AfterConnect = func(ctx context.Context, conn *sql.Conn) error {
+		return errors.New("set role failed")
+	}
+	p.MinConns = 1
+	if err = p.Warm(context.Background()); err == nil || !strings.Contains(err.Error(), "set role failed") {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolWarmContext(t *testing.T) {
+	var tc = &testConnector{block: make(chan struct{})}
+	var db = sql.OpenDB(tc)
+	defer db.Close()
+
+	var p = NewPool(db)
+	p.MinConns = 2
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var start = time.Now()
+	if err := p.Warm(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestPoolDrain(t *testing.T) {
+	var tc = new(testConnector)
+	var db = sql.OpenDB(tc)
+	var p = NewPool(db)
+
+	idle, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Release(idle); err != nil {
+		t.Fatal(err)
+	}
+
+	var drained = make(chan error, 1)
+	go func() {
+		drained <- p.Drain(context.Background())
+	}()
+	// 取出的连接归还之前 Drain 一直等待
+	select {
+	case err = <-drained:
+		t.Fatal("Drain returned before the connection was released:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err = p.Acquire(context.Background()); err != ErrPoolDrained {
+		t.Fatal(err)
+	}
+	if err = p.Release(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if opened, closed := tc.counts(); opened != 2 || closed != 2 {
+		t.Fatal(opened, closed)
+	}
+	// 重复调用直接返回
+	if err = p.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolDrainContext(t *testing.T) {
+	var tc = new(testConnector)
+	var p = NewPool(sql.OpenDB(tc))
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err = p.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	// 未归还的连接在 Release 时关闭
+	if err = p.Release(conn); err != nil {
+		t.Fatal(err)
+	}
+	if opened, closed := tc.counts(); opened != 1 || closed != 1 {
+		t.Fatal(opened, closed)
+	}
+}